@@ -0,0 +1,137 @@
+/*
+ * Copyright (C) 2018 Keaton Bruce
+ *
+ * This file is part of nano-prepowtx.
+ *
+ * nano-prepowtx is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * nano-prepowtx is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with nano-prepowtx. If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+    "fmt"
+    "net"
+    "strings"
+    "sync"
+)
+
+/*
+ * Peers are known by the address they advertise in hello, as host:port, and
+ * never by the address a connection comes from, since its port is ephemeral.
+ * Addresses are always split and joined with net.SplitHostPort and
+ * net.JoinHostPort, so IPv6 hosts keep their brackets: [::1]:9887.
+ *
+ * The advertised address of this node is -advertise when it is given, else
+ * the listen address when that names a host. Listening on every interface,
+ * the host is learned from the first peer, which answers hello with the
+ * address it saw the connection come from, and joined with the listen port.
+ */
+
+// The port this node listens on, empty when it does not listen.
+var ListenPort string
+
+var myAddress string
+var aLock sync.Mutex
+
+// peerAddress returns an address as host:port, with the default port if it
+// has none.
+func peerAddress(s, defaultPort string) (string, error) {
+    s = strings.TrimSpace(s)
+    host, port, err := net.SplitHostPort(s)
+    if (err != nil) {
+        // A bare host, maybe an IPv6 one in brackets.
+        host = strings.TrimSuffix(strings.TrimPrefix(s, "["), "]")
+        port = defaultPort
+    }
+    if (host == "" || port == "") {
+        return "", fmt.Errorf("%q is not a peer address", s)
+    }
+    return net.JoinHostPort(host, port), nil
+}
+
+// remoteHost returns the host that a connection comes from.
+func remoteHost(conn net.Conn) (string) {
+    host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+    if err != nil {
+        return conn.RemoteAddr().String()
+    }
+    return host
+}
+
+// setupAddress sets the advertised address from the listener and -advertise.
+func setupAddress(ln net.Listener, advertise string) (error) {
+    host, port, err := net.SplitHostPort(ln.Addr().String())
+    if err != nil {
+        return err
+    }
+    ListenPort = port
+    if (advertise != "") {
+        address, err := peerAddress(advertise, port)
+        if err != nil {
+            return err
+        }
+        setAddress(address)
+        return nil
+    }
+    ip := net.ParseIP(host)
+    if (host != "" && (ip == nil || !ip.IsUnspecified())) {
+        setAddress(net.JoinHostPort(host, port))
+    }
+    return nil
+}
+
+func setAddress(address string) {
+    aLock.Lock()
+    myAddress = address
+    aLock.Unlock()
+    fmt.Println("My Address:", address)
+}
+
+// advertised returns the address of this node, empty while it is not known.
+func advertised() (string) {
+    aLock.Lock()
+    defer aLock.Unlock()
+    return myAddress
+}
+
+// learnAddress takes the host that a peer saw us come from as our own, if
+// there is no better one.
+func learnAddress(observed string) {
+    if (ListenPort == "" || advertised() != "") {
+        return
+    }
+    host, _, err := net.SplitHostPort(observed)
+    if err != nil {
+        return
+    }
+    setAddress(net.JoinHostPort(host, ListenPort))
+}
+
+// helloAddress returns the address a peer advertised in hello. A peer that
+// does not know its host gets the host its connection comes from.
+func helloAddress(conn net.Conn, advertised string) (string) {
+    if (advertised == "") {
+        return ""
+    }
+    host, port, err := net.SplitHostPort(advertised)
+    if err != nil {
+        return ""
+    }
+    ip := net.ParseIP(host)
+    if (host == "" || (ip != nil && ip.IsUnspecified())) {
+        host = remoteHost(conn)
+    }
+    return net.JoinHostPort(host, port)
+}
@@ -0,0 +1,82 @@
+/*
+ * Copyright (C) 2018 Keaton Bruce
+ *
+ * This file is part of nano-prepowtx.
+ *
+ * nano-prepowtx is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * nano-prepowtx is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with nano-prepowtx. If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+    "net"
+    "testing"
+)
+
+func TestPeerAddress(t *testing.T) {
+    for _, tc := range []struct {
+        in, want string
+    }{
+        {"[::1]:7090", "[::1]:7090"},
+        {"::1", "[::1]:9887"},
+        {"[::1]", "[::1]:9887"},
+        {"2001:db8::7", "[2001:db8::7]:9887"},
+        {"10.0.0.1", "10.0.0.1:9887"},
+        {" 10.0.0.1:7090 ", "10.0.0.1:7090"},
+        {"seed.example.org", "seed.example.org:9887"},
+        {"", ""},
+        {":7090", ""},
+    } {
+        got, err := peerAddress(tc.in, "9887")
+        if (tc.want == "" && err == nil) {
+            t.Errorf("peerAddress(%q) = %q, want an error", tc.in, got)
+        } else if (tc.want != "" && (err != nil || got != tc.want)) {
+            t.Errorf("peerAddress(%q) = %q, %v, want %q", tc.in, got, err, tc.want)
+        }
+    }
+}
+
+// observedConn is a connection that only has a remote address.
+type observedConn struct {
+    net.Conn
+    remote net.Addr
+}
+
+func (c observedConn) RemoteAddr() (net.Addr) {
+    return c.remote
+}
+
+func TestHelloAddress(t *testing.T) {
+    v4 := observedConn{remote: &net.TCPAddr{IP: net.ParseIP("192.0.2.4"), Port: 51234}}
+    v6 := observedConn{remote: &net.TCPAddr{IP: net.ParseIP("2001:db8::4"), Port: 51234}}
+    for _, tc := range []struct {
+        conn net.Conn
+        advertised, want string
+    }{
+        {v4, "", ""},
+        {v4, "not an address", ""},
+        {v4, "198.51.100.9:7090", "198.51.100.9:7090"},
+        {v4, "[::1]:7090", "[::1]:7090"},
+        // A peer that does not know its host is reached at the one it came from.
+        {v4, ":7090", "192.0.2.4:7090"},
+        {v4, "0.0.0.0:7090", "192.0.2.4:7090"},
+        {v6, "[::]:7090", "[2001:db8::4]:7090"},
+        {v6, ":7090", "[2001:db8::4]:7090"},
+    } {
+        if got := helloAddress(tc.conn, tc.advertised); (got != tc.want) {
+            t.Errorf("helloAddress(%s, %q) = %q, want %q", tc.conn.RemoteAddr(), tc.advertised, got, tc.want)
+        }
+    }
+}
@@ -0,0 +1,227 @@
+/*
+ * Copyright (C) 2018 Keaton Bruce
+ *
+ * This file is part of nano-prepowtx.
+ *
+ * nano-prepowtx is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * nano-prepowtx is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with nano-prepowtx. If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+    "fmt"
+    "os"
+    "bufio"
+    "encoding/json"
+    "encoding/hex"
+    "crypto/sha256"
+)
+
+/*
+ * A bundle is a file of offline signed blocks that can be carried from the
+ * machine that precomputed them to the machine that publishes them.
+ *
+ * The first line is a json BundleHeader. Every following line is a json
+ * BundleBlock, in the order that the blocks have to be published.
+ * The checksum in the header is the sha256 of every block line (including
+ * the newline) so a truncated or edited file is rejected before publishing.
+ */
+
+const BundleVersion = 1
+
+type BundleHeader struct {
+    Version uint `json:"version"`
+    Network string `json:"network"`
+    Accounts []string `json:"accounts"`
+    // The frontier of every account before the first block in the bundle.
+    // Empty if the bundle has no blocks for that account.
+    Frontiers []string `json:"frontiers"`
+    Count uint64 `json:"count"`
+    Checksum string `json:"checksum"`
+}
+
+type BundleBlock struct {
+    Account uint64 `json:"account"`
+    Hash string `json:"hash"`
+    Block string `json:"block"`
+    // The difficulty of the work when the block was created, zero if unknown.
+    Difficulty uint64 `json:"difficulty"`
+}
+
+// The network the blocks are signed for. Bundles are only published
+// to a node of the same network.
+var Network string
+
+// ExportBundle writes the blocks, in publishing order, to a bundle file.
+func ExportBundle(path string, a *Arena) {
+    var header BundleHeader
+    header.Version = BundleVersion
+    header.Network = Network
+    header.Accounts = Accounts[:NAccounts]
+    header.Frontiers = make([]string, NAccounts)
+    header.Count = a.Len()
+
+    // The first block of every account points to its starting frontier.
+    seen := make([]bool, NAccounts)
+    for i := uint64(0); i < a.Len(); i++ {
+        p := a.Get(i)
+        if (seen[p.Account]) {
+            continue
+        }
+        seen[p.Account] = true
+        header.Frontiers[p.Account] = p.PreviousString()
+    }
+
+    lines := make([][]byte, a.Len())
+    sum := sha256.New()
+    for i := range lines {
+        p := a.Get(uint64(i))
+        line, err := json.Marshal(BundleBlock{uint64(p.Account), p.HashString(), p.JSON(), p.Difficulty})
+        if err != nil {
+            fmt.Println(err)
+            os.Exit(1)
+        }
+        lines[i] = append(line, '\n')
+        sum.Write(lines[i])
+    }
+    header.Checksum = hex.EncodeToString(sum.Sum(nil))
+
+    f, err := os.Create(path)
+    if err != nil {
+        fmt.Println(err)
+        os.Exit(1)
+    }
+    w := bufio.NewWriter(f)
+
+    h, err := json.Marshal(header)
+    if err != nil {
+        fmt.Println(err)
+        os.Exit(1)
+    }
+    w.Write(append(h, '\n'))
+    for _, line := range lines {
+        w.Write(line)
+    }
+
+    err = w.Flush()
+    if err == nil {
+        err = f.Close()
+    }
+    if err != nil {
+        fmt.Println(err)
+        os.Exit(1)
+    }
+    fmt.Println("Exported", header.Count, "blocks to:", path)
+}
+
+// ImportBundle reads a bundle file and verifies its checksum.
+func ImportBundle(path string) (BundleHeader, *Arena) {
+    var header BundleHeader
+
+    f, err := os.Open(path)
+    if err != nil {
+        fmt.Println(err)
+        os.Exit(1)
+    }
+    defer f.Close()
+
+    r := bufio.NewReader(f)
+    line, err := r.ReadBytes('\n')
+    if err != nil {
+        fmt.Println("Error: Unable to read bundle header:", err)
+        os.Exit(1)
+    }
+    err = json.Unmarshal(line, &header)
+    if err != nil {
+        fmt.Println("Error: Unable to read bundle header:", err)
+        os.Exit(1)
+    }
+    if (header.Version != BundleVersion) {
+        fmt.Println("Error: Unsupported bundle version", header.Version)
+        os.Exit(1)
+    }
+    if (len(header.Frontiers) != len(header.Accounts)) {
+        fmt.Println("Error: The bundle header has", len(header.Accounts), "accounts but", len(header.Frontiers), "frontiers")
+        os.Exit(1)
+    }
+
+    indexAddresses(header.Accounts)
+    blocks := &Arena{}
+    sum := sha256.New()
+    for {
+        line, err = r.ReadBytes('\n')
+        if (len(line) == 0) {
+            break
+        }
+        sum.Write(line)
+        var b BundleBlock
+        if json.Unmarshal(line, &b) != nil || b.Account >= uint64(len(header.Accounts)) {
+            fmt.Println("Error: Malformed bundle block", blocks.Len())
+            os.Exit(1)
+        }
+        blocks.Append(PackBlock(b.Account, b.Hash, b.Block, b.Difficulty))
+        if err != nil {
+            break
+        }
+    }
+
+    if (blocks.Len() != header.Count) {
+        fmt.Println("Error: The bundle should have", header.Count, "blocks but has", blocks.Len())
+        os.Exit(1)
+    }
+    if (hex.EncodeToString(sum.Sum(nil)) != header.Checksum) {
+        fmt.Println("Error: The bundle checksum does not match")
+        os.Exit(1)
+    }
+    return header, blocks
+}
+
+// VerifyFrontiers checks that no account in the bundle has moved on since
+// the bundle was created. Any other block would fork the precomputed chain.
+func VerifyFrontiers(header BundleHeader) (bool) {
+    frontiers := GetFrontiers(header.Accounts)
+    ok := true
+    for k, account := range header.Accounts {
+        if (header.Frontiers[k] == "") {
+            continue
+        }
+        if (frontiers[account] != header.Frontiers[k]) {
+            fmt.Println("Frontier mismatch for:", account, "expected:", header.Frontiers[k], "found:", frontiers[account])
+            ok = false
+        }
+    }
+    return ok
+}
+
+// publishBundle is the publish-only mode. The blocks are loaded from the
+// bundle, checked against the ledger and then published in order.
+func publishBundle(path string) {
+    header, blocks := ImportBundle(path)
+    fmt.Println("Imported", header.Count, "blocks for", len(header.Accounts), "accounts from:", path)
+
+    if (header.Network != Network) {
+        fmt.Println("Error: The bundle is for the", header.Network, "network, not", Network)
+        os.Exit(1)
+    }
+    if (!VerifyFrontiers(header)) {
+        fmt.Println("Error: The account frontiers no longer match the bundle")
+        os.Exit(1)
+    }
+
+    Accounts = header.Accounts
+    NAccounts = uint64(len(Accounts))
+    ReworkBlocks(Campaign, blocks)
+    publishBlocks(Campaign, blocks)
+}
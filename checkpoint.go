@@ -0,0 +1,155 @@
+/*
+ * Copyright (C) 2018 Keaton Bruce
+ *
+ * This file is part of nano-prepowtx.
+ *
+ * nano-prepowtx is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * nano-prepowtx is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with nano-prepowtx. If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+    "fmt"
+    "os"
+    "io/ioutil"
+    "encoding/json"
+)
+
+/*
+ * The round state of a campaign is checkpointed after every published round,
+ * so a restarted process continues with the right phase instead of always
+ * starting with a send round.
+ *
+ * A round that was stopped part way through publishing leaves the ledger
+ * ahead of the checkpoint. When the frontiers of the node no longer match,
+ * the frontiers are taken from the node and the sends that still have to be
+ * received are taken from the pending blocks of every account.
+ */
+
+const CheckpointVersion = 1
+
+type Checkpoint struct {
+    Version uint `json:"version"`
+    Wallet string `json:"wallet"`
+    Accounts []string `json:"accounts"`
+    // The next round to run and its phase.
+    Round int64 `json:"round"`
+    Phase string `json:"phase"`
+    // Whether the last round was stopped before all of it was published.
+    Partial bool `json:"partial"`
+    Heights []uint64 `json:"heights"`
+    Frontiers []string `json:"frontiers"`
+    Pending []Transfer `json:"pending"`
+}
+
+// The number of pending blocks to ask the node for at once when resuming.
+const resumePending = "1000"
+
+// phase returns the name of the phase of a round.
+func phase(round int64) (string) {
+    if (Pipeline) {
+        return "pipeline"
+    }
+    if (round % 2 == 0) {
+        return "send"
+    }
+    return "receive"
+}
+
+// SaveCheckpoint writes the state of the campaign before the next round.
+func SaveCheckpoint(path string, next int64, partial bool) {
+    cp := Checkpoint{CheckpointVersion, Wallet, Accounts[:NAccounts], next, phase(next), partial, Heights, Frontiers, Pending}
+    b, err := json.MarshalIndent(cp, "", "    ")
+    if err != nil {
+        fmt.Println(err)
+        os.Exit(1)
+    }
+    // Replace the old checkpoint in one step so a crash never leaves half of one.
+    err = ioutil.WriteFile(path + ".tmp", b, 0644)
+    if err == nil {
+        err = os.Rename(path + ".tmp", path)
+    }
+    if err != nil {
+        fmt.Println("Error: Unable to write the checkpoint:", err)
+        os.Exit(1)
+    }
+}
+
+// LoadCheckpoint restores the state of the campaign and returns the next round.
+// Without a checkpoint the campaign starts at round zero.
+func LoadCheckpoint(path string) (int64) {
+    b, err := ioutil.ReadFile(path)
+    if os.IsNotExist(err) {
+        return 0
+    }
+    if err != nil {
+        fmt.Println("Error: Unable to read the checkpoint:", err)
+        os.Exit(1)
+    }
+    var cp Checkpoint
+    err = json.Unmarshal(b, &cp)
+    if err != nil {
+        fmt.Println("Error: Unable to read the checkpoint:", err)
+        os.Exit(1)
+    }
+    if (cp.Version != CheckpointVersion) {
+        fmt.Println("Error: Unsupported checkpoint version", cp.Version)
+        os.Exit(1)
+    }
+    if (cp.Wallet != Wallet || len(cp.Accounts) != int(NAccounts) || len(cp.Heights) != int(NAccounts) || len(cp.Frontiers) != int(NAccounts)) {
+        fmt.Println("Error: The checkpoint is for a different wallet or number of accounts")
+        os.Exit(1)
+    }
+    for k, account := range cp.Accounts {
+        if (account != Accounts[k]) {
+            fmt.Println("Error: The checkpoint has a different account", k, account)
+            os.Exit(1)
+        }
+    }
+    if (cp.Phase != phase(cp.Round)) {
+        fmt.Println("Warning: The checkpoint was in the", cp.Phase, "phase, continuing in the", phase(cp.Round), "phase")
+    }
+
+    if (cp.Partial) {
+        fmt.Println("The last round was stopped while publishing")
+    }
+    copy(Heights, cp.Heights)
+
+    frontiers := GetFrontiers(Accounts[:NAccounts])
+    moved := false
+    for k, account := range Accounts[:NAccounts] {
+        if (frontiers[account] != cp.Frontiers[k]) {
+            moved = true
+        }
+    }
+    if (!moved) {
+        copy(Frontiers, cp.Frontiers)
+        Pending = cp.Pending
+    } else {
+        fmt.Println("The ledger has moved since the checkpoint, resuming from the ledger")
+        for k, account := range Accounts[:NAccounts] {
+            Frontiers[k] = frontiers[account]
+        }
+        Pending = Pending[:0]
+        for k, account := range Accounts[:NAccounts] {
+            for _, hash := range GetPendingBlocks(account, resumePending) {
+                Pending = append(Pending, Transfer{uint64(k), hash})
+            }
+        }
+    }
+
+    fmt.Println("Resuming at Round:", cp.Round, "Phase:", phase(cp.Round), "Pending Receives:", len(Pending))
+    return cp.Round
+}
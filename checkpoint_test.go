@@ -0,0 +1,101 @@
+/*
+ * Copyright (C) 2018 Keaton Bruce
+ *
+ * This file is part of nano-prepowtx.
+ *
+ * nano-prepowtx is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * nano-prepowtx is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with nano-prepowtx. If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+    "testing"
+    "net/http"
+    "net/http/httptest"
+    "path/filepath"
+    "encoding/json"
+)
+
+// ledgerNode answers accounts_frontiers and pending like a node with these
+// frontiers and pending blocks.
+func ledgerNode(t *testing.T, frontiers map[string]string, pending map[string][]string) {
+    srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        var req struct {
+            Action string `json:"action"`
+            Account string `json:"account"`
+        }
+        json.NewDecoder(r.Body).Decode(&req)
+        switch req.Action {
+        case "accounts_frontiers":
+            json.NewEncoder(w).Encode(AFResponse{frontiers})
+        case "pending":
+            json.NewEncoder(w).Encode(PResponse{pending[req.Account]})
+        default:
+            w.Write([]byte(`{"error":"unexpected action"}`))
+        }
+    }))
+    t.Cleanup(srv.Close)
+    Nodes = []string{srv.URL}
+}
+
+func TestLoadCheckpoint(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "state.json")
+    Wallet = "wallet"
+    setupRound(3)
+    Heights = []uint64{4, 5, 6}
+    Pending = []Transfer{{1, "S1"}, {2, "S2"}}
+    SaveCheckpoint(path, 7, false)
+    saved := append([]string(nil), Frontiers...)
+    ledger := make(map[string]string)
+    for k, account := range Accounts {
+        ledger[account] = Frontiers[k]
+    }
+
+    // The ledger is where the checkpoint left it.
+    setupRound(3)
+    ledgerNode(t, ledger, nil)
+    if round := LoadCheckpoint(path); (round != 7) {
+        t.Fatalf("resumed at round %d, want 7", round)
+    }
+    if (len(Pending) != 2 || Pending[0] != (Transfer{1, "S1"}) || Pending[1] != (Transfer{2, "S2"})) {
+        t.Fatalf("Pending = %v", Pending)
+    }
+    for k := range Frontiers {
+        if (Frontiers[k] != saved[k] || Heights[k] != uint64(4 + k)) {
+            t.Fatalf("account %d resumed at %s height %d", k, Frontiers[k], Heights[k])
+        }
+    }
+
+    // A stopped round published a send of account 0 and the receive of S1.
+    setupRound(3)
+    ledger[Accounts[0]] = "F0"
+    ledger[Accounts[1]] = "F1"
+    ledgerNode(t, ledger, map[string][]string{Accounts[1]: {"P1"}, Accounts[2]: {"S2", "P2"}})
+    if round := LoadCheckpoint(path); (round != 7) {
+        t.Fatalf("resumed at round %d, want 7", round)
+    }
+    if (Frontiers[0] != "F0" || Frontiers[1] != "F1" || Frontiers[2] != saved[2]) {
+        t.Fatalf("Frontiers = %v", Frontiers)
+    }
+    want := []Transfer{{1, "P1"}, {2, "S2"}, {2, "P2"}}
+    if (len(Pending) != len(want)) {
+        t.Fatalf("Pending = %v, want %v", Pending, want)
+    }
+    for i := range want {
+        if (Pending[i] != want[i]) {
+            t.Fatalf("Pending = %v, want %v", Pending, want)
+        }
+    }
+}
@@ -0,0 +1,169 @@
+/*
+ * Copyright (C) 2018 Keaton Bruce
+ *
+ * This file is part of nano-prepowtx.
+ *
+ * nano-prepowtx is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * nano-prepowtx is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with nano-prepowtx. If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+    "fmt"
+    "sort"
+    "sync"
+    "time"
+)
+
+/*
+ * A synchronized burst needs the clocks of the cluster to agree, and the
+ * clocks of lab machines easily drift by seconds. The offset to every peer is
+ * estimated like NTP does: a time_sync request carries the time it was sent
+ * (t1), the peer answers with the times it received it (t2) and answered it
+ * (t3), and the answer arrives at t4.
+ *
+ *     offset = ((t2 - t1) + (t3 - t4)) / 2
+ *     rtt    = (t4 - t1) - (t3 - t2)
+ *
+ * Of a few samples the one with the smallest round trip is kept, since it has
+ * the least room for asymmetric delays. The cluster clock is the local clock
+ * moved by the median offset of the peers and of this node (zero), so every
+ * instance moves towards the same median clock. The schedule is kept in
+ * cluster time and only turned into local time to wait for the attack.
+ */
+
+const ActionTimeSync = "time_sync"
+
+// The number of time_sync requests for every estimate.
+const ClockSamples = 4
+
+// A peer whose clock is further off than this is warned about.
+var ClockTolerance = 500 * time.Millisecond
+
+type ClockSample struct {
+    Originate time.Time
+    Receive time.Time
+    Transmit time.Time
+}
+
+type ClockEstimate struct {
+    Offset time.Duration
+    RTT time.Duration
+    At time.Time
+}
+
+// The estimates of the clock of every peer, by address.
+var PeerClocks = make(map[string]ClockEstimate)
+
+// The offset of the cluster clock to the local clock.
+var clockOffset time.Duration
+var clockLock sync.Mutex
+
+// clusterNow returns the time on the cluster clock.
+func clusterNow() (time.Time) {
+    return time.Now().Add(ClockOffset())
+}
+
+// localTime turns a time on the cluster clock into one on the local clock.
+func localTime(t time.Time) (time.Time) {
+    return t.Add(-ClockOffset())
+}
+
+func ClockOffset() (time.Duration) {
+    clockLock.Lock()
+    defer clockLock.Unlock()
+    return clockOffset
+}
+
+// measureClock estimates the offset and round trip to a peer.
+func measureClock(address string) (ClockEstimate, error) {
+    c, err := dialPeer(address)
+    if err != nil {
+        return ClockEstimate{}, err
+    }
+    defer c.conn.Close()
+    if (!c.Capable(ActionTimeSync)) {
+        return ClockEstimate{}, fmt.Errorf("%s does not handle %s", address, ActionTimeSync)
+    }
+    var best ClockEstimate
+    for i := 0; i < ClockSamples; i++ {
+        t1 := time.Now()
+        r, err := c.Call(ActionTimeSync, Message{Clock: &ClockSample{Originate: t1}})
+        t4 := time.Now()
+        if err != nil {
+            return ClockEstimate{}, err
+        }
+        if (r.Clock == nil) {
+            return ClockEstimate{}, fmt.Errorf("%s answered time_sync without times", address)
+        }
+        t2 := r.Clock.Receive
+        t3 := r.Clock.Transmit
+        e := ClockEstimate{(t2.Sub(t1) + t3.Sub(t4)) / 2, t4.Sub(t1) - t3.Sub(t2), t4}
+        if (i == 0 || e.RTT < best.RTT) {
+            best = e
+        }
+    }
+    return best, nil
+}
+
+// syncClocks estimates the clocks of every known peer and moves the cluster
+// clock to their median.
+func syncClocks() {
+    var wg sync.WaitGroup
+    for _, address := range peerList() {
+        wg.Add(1)
+        go func(address string) {
+            defer wg.Done()
+            e, err := measureClock(address)
+            if err != nil {
+                fmt.Println("Error: Peer", address, ActionTimeSync, err)
+                return
+            }
+            if (e.Offset > ClockTolerance || e.Offset < -ClockTolerance) {
+                fmt.Println("Warning: The clock of peer", address, "is off by", e.Offset, "(rtt", e.RTT, ")")
+            }
+            clockLock.Lock()
+            PeerClocks[address] = e
+            clockLock.Unlock()
+        }(address)
+    }
+    wg.Wait()
+
+    clockLock.Lock()
+    defer clockLock.Unlock()
+    offsets := []time.Duration{0}
+    for address, e := range PeerClocks {
+        // Forget the peers that did not answer for a while.
+        if (time.Since(e.At) > LiveIntervals * time.Duration(tCompute) * time.Second) {
+            delete(PeerClocks, address)
+            continue
+        }
+        offsets = append(offsets, e.Offset)
+    }
+    sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+    offset := offsets[len(offsets) / 2]
+    if (offset != clockOffset) {
+        fmt.Println("Cluster Clock Offset:", offset, "from", len(offsets) - 1, "peers")
+    }
+    clockOffset = offset
+}
+
+func handleTimeSync(c *PeerConn, m Message) (Message) {
+    received := time.Now()
+    if (m.Clock == nil) {
+        return protocolError(ErrCodeBadRequest, "time_sync without times")
+    }
+    return Message{Header: Header{Action: ActionTimeSync}, Clock: &ClockSample{m.Clock.Originate, received, time.Now()}}
+}
@@ -0,0 +1,157 @@
+/*
+ * Copyright (C) 2018 Keaton Bruce
+ *
+ * This file is part of nano-prepowtx.
+ *
+ * nano-prepowtx is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * nano-prepowtx is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with nano-prepowtx. If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+    "fmt"
+    "sort"
+    "time"
+)
+
+/*
+ * Coordinated instances attack together. Before every round an instance
+ * takes the median of the next attack and of the interval that it and every
+ * live peer announced, adopts it and announces it. Every instance takes the
+ * median of the same announcements, so they agree within a round or two.
+ * Announcements are kept by the identity of the peer, so a peer has one vote
+ * however often it reconnects. All of these times are on the cluster clock.
+ *
+ * An instance that joins a running cluster asks its seed peers for their
+ * schedule with get_schedule and starts on it right away.
+ */
+
+const ActionGetSchedule = "get_schedule"
+
+// A peer is live while it announced within this many intervals.
+const LiveIntervals = 2
+
+type PeerSchedule struct {
+    Announcement
+    // When the announcement was received.
+    Heard time.Time
+}
+
+// The announcements of the peers, by identity.
+var Announced = make(map[string]PeerSchedule)
+
+// The schedule that this node attacks on, zero before the first round.
+var Current Announcement
+
+// usable reports whether a schedule can be attacked on. Schedule.Next
+// divides by the interval, which may not be shorter than the one -interval
+// allows.
+func usable(a Announcement) (bool) {
+    return a.Interval >= time.Second && !a.Next.IsZero()
+}
+
+// project returns the first attack of an announced schedule after now.
+func project(a Announcement, now time.Time) (time.Time) {
+    if (a.Interval <= 0 || a.Next.After(now)) {
+        return a.Next
+    }
+    next := a.Next.Add(now.Sub(a.Next) / a.Interval * a.Interval)
+    if (!next.After(now)) {
+        next = next.Add(a.Interval)
+    }
+    return next
+}
+
+// agree returns the median of the local schedule and those of the live peers.
+func agree(local Announcement, now time.Time) (Announcement) {
+    nexts := []time.Time{local.Next}
+    intervals := []time.Duration{local.Interval}
+    pLock.Lock()
+    for key, p := range Announced {
+        interval := p.Interval
+        if (local.Interval > interval) {
+            interval = local.Interval
+        }
+        if (now.Sub(p.Heard) > LiveIntervals * interval) {
+            delete(Announced, key)
+            continue
+        }
+        nexts = append(nexts, project(p.Announcement, now))
+        intervals = append(intervals, p.Interval)
+    }
+    pLock.Unlock()
+    sort.Slice(nexts, func(i, j int) bool { return nexts[i].Before(nexts[j]) })
+    sort.Slice(intervals, func(i, j int) bool { return intervals[i] < intervals[j] })
+    return Announcement{local.Round, nexts[len(nexts) / 2], intervals[len(intervals) / 2]}
+}
+
+// agreeSchedule moves the schedule onto the one the cluster agrees on,
+// announces it and returns the next attack.
+func agreeSchedule(s *Schedule, round int64, next time.Time) (time.Time) {
+    a := agree(Announcement{round, next, s.Interval}, clusterNow())
+    if (!a.Next.Equal(next) || a.Interval != s.Interval) {
+        fmt.Println("Cluster Schedule: Next Attack", a.Next.Format(time.UnixDate), "Interval", a.Interval)
+    }
+    adopt(s, a)
+    broadcast(ActionAnnounceSchedule, Message{Schedule: &a})
+    return a.Next
+}
+
+// adopt attacks on a schedule from its next attack on.
+func adopt(s *Schedule, a Announcement) {
+    s.Start = a.Next
+    s.Interval = a.Interval
+    tCompute = int64(a.Interval / time.Second)
+    pLock.Lock()
+    Current = a
+    pLock.Unlock()
+}
+
+// joinCluster adopts the schedule of the first seed that has one.
+func joinCluster(s *Schedule, seeds []string) {
+    for _, seed := range seeds {
+        c, err := dialPeer(seed)
+        var r Message
+        if err == nil {
+            r, err = c.Call(ActionGetSchedule, Message{})
+            c.conn.Close()
+        }
+        if err != nil {
+            fmt.Println("Error: Peer", seed, err)
+            continue
+        }
+        if (r.Schedule == nil || !usable(*r.Schedule)) {
+            continue
+        }
+        now := clusterNow()
+        a := Announcement{r.Schedule.Round, project(*r.Schedule, now), r.Schedule.Interval}
+        pLock.Lock()
+        Announced[c.key] = PeerSchedule{*r.Schedule, now}
+        pLock.Unlock()
+        adopt(s, a)
+        fmt.Println("Joined the Cluster Schedule of", seed, "Next Attack:", a.Next.Format(time.UnixDate), "Interval:", a.Interval)
+        return
+    }
+}
+
+func handleGetSchedule(c *PeerConn, m Message) (Message) {
+    pLock.Lock()
+    defer pLock.Unlock()
+    if (Current.Interval == 0) {
+        return protocolError(ErrCodeUnavailable, "no schedule yet")
+    }
+    a := Current
+    return Message{Header: Header{Action: ActionGetSchedule}, Schedule: &a}
+}
@@ -0,0 +1,77 @@
+/*
+ * Copyright (C) 2018 Keaton Bruce
+ *
+ * This file is part of nano-prepowtx.
+ *
+ * nano-prepowtx is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * nano-prepowtx is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with nano-prepowtx. If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+    "fmt"
+    "time"
+    "testing"
+)
+
+// Peers that announce an unusable schedule must not move the median onto it,
+// a zero interval would divide by zero in Schedule.Next.
+func TestAnnounceUnusableSchedule(t *testing.T) {
+    Announced = make(map[string]PeerSchedule)
+    now := time.Now()
+    for i, a := range []Announcement{
+        {1, now.Add(time.Minute), 0},
+        {1, now.Add(time.Minute), -time.Minute},
+        {1, now.Add(time.Minute), time.Millisecond},
+        {1, time.Time{}, time.Minute},
+    } {
+        c := &PeerConn{key: fmt.Sprint("peer", i)}
+        r := handleAnnounceSchedule(c, Message{Schedule: &a})
+        if (r.Error == nil || r.Error.Code != ErrCodeBadRequest) {
+            t.Fatalf("announcement %+v was answered with %+v", a, r)
+        }
+    }
+    if (len(Announced) != 0) {
+        t.Fatalf("unusable announcements were kept: %v", Announced)
+    }
+
+    local := Announcement{1, now.Add(time.Minute), 5 * time.Minute}
+    for i := 0; i < 3; i++ {
+        a := Announcement{1, now.Add(2 * time.Minute), 3 * time.Minute}
+        handleAnnounceSchedule(&PeerConn{key: fmt.Sprint("good", i)}, Message{Schedule: &a})
+    }
+    // Without an identity, or from new addresses of an identity, there are
+    // no more votes.
+    for i := 0; i < 3; i++ {
+        a := Announcement{1, now.Add(time.Hour), time.Hour}
+        r := handleAnnounceSchedule(&PeerConn{address: fmt.Sprint("127.0.0.1:", 40000 + i)}, Message{Schedule: &a})
+        if (r.Error == nil || r.Error.Code != ErrCodeBadRequest) {
+            t.Fatalf("an announcement without an identity was answered with %+v", r)
+        }
+        handleAnnounceSchedule(&PeerConn{key: "bad", address: fmt.Sprint("127.0.0.1:", 40000 + i)}, Message{Schedule: &a})
+    }
+    if (len(Announced) != 4) {
+        t.Fatalf("%d announcements of 4 identities were kept", len(Announced))
+    }
+    agreed := agree(local, now)
+    if (agreed.Interval != 3 * time.Minute || !agreed.Next.Equal(now.Add(2 * time.Minute))) {
+        t.Fatalf("agreed on %+v", agreed)
+    }
+    s := Schedule{Interval: agreed.Interval}
+    adopt(&s, agreed)
+    if next := s.Next(now.Add(10 * time.Minute)); (!next.After(now.Add(10 * time.Minute))) {
+        t.Fatalf("Next = %v", next)
+    }
+}
@@ -0,0 +1,242 @@
+/*
+ * Copyright (C) 2018 Keaton Bruce
+ *
+ * This file is part of nano-prepowtx.
+ *
+ * nano-prepowtx is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * nano-prepowtx is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with nano-prepowtx. If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+    "fmt"
+    "sort"
+    "sync"
+    "time"
+)
+
+/*
+ * Publishing a block is not the same as confirming it. Every block that the
+ * node accepted is tracked from the moment it was published until blocks_info
+ * reports it as confirmed. Blocks that are still unconfirmed after a quarter
+ * of the timeout get a block_confirm to start an election for them.
+ *
+ * The latency is measured when a poll sees the block confirmed, so it is only
+ * as precise as the poll interval.
+ *
+ * Tracking must not slow down the publishing it measures. Track only appends
+ * to a list that the tracker takes over on its next poll, and the polls and
+ * block_confirm requests run ConfirmRequests at a time. A request that fails
+ * is printed and tried again on the next poll, until the block times out.
+ */
+
+// The largest number of hashes in a single blocks_info request.
+const ConfirmBatch = 1000
+// The number of blocks_info and block_confirm requests that run at once.
+const ConfirmRequests = 4
+
+// Track confirmations at all.
+var Confirm bool
+var ConfirmTimeout time.Duration
+var ConfirmInterval time.Duration
+
+// The trackers that are still running, waited for at the end of the campaign.
+var Trackers sync.WaitGroup
+
+// Protects the confirmation reports of the Summary.
+var cLock sync.Mutex
+
+type ConfirmReport struct {
+    Round int `json:"round"`
+    Published uint64 `json:"published"`
+    Confirmed uint64 `json:"confirmed"`
+    Unconfirmed uint64 `json:"unconfirmed"`
+    P50 time.Duration `json:"p50"`
+    P90 time.Duration `json:"p90"`
+    P99 time.Duration `json:"p99"`
+    Max time.Duration `json:"max"`
+}
+
+type tracked struct {
+    hash string
+    at time.Time
+}
+
+type ConfirmTracker struct {
+    round int
+    // The blocks published since the last poll, and whether the round has
+    // nothing more to publish.
+    mu sync.Mutex
+    published []tracked
+    closed bool
+}
+
+// StartConfirmations starts to track the confirmations of a round.
+func StartConfirmations(round int) (*ConfirmTracker) {
+    t := &ConfirmTracker{round: round}
+    Trackers.Add(1)
+    go t.run()
+    return t
+}
+
+// Track starts the clock for a block that was just published. It never waits
+// for the tracker.
+func (t *ConfirmTracker) Track(hash string) {
+    t.mu.Lock()
+    t.published = append(t.published, tracked{hash, time.Now()})
+    t.mu.Unlock()
+}
+
+// Close tells the tracker that the round has nothing more to publish.
+// It keeps polling until every block is confirmed or timed out.
+func (t *ConfirmTracker) Close() {
+    t.mu.Lock()
+    t.closed = true
+    t.mu.Unlock()
+}
+
+// take returns the blocks published since the last call, and whether more
+// may follow.
+func (t *ConfirmTracker) take() ([]tracked, bool) {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    published := t.published
+    t.published = nil
+    return published, !t.closed
+}
+
+func (t *ConfirmTracker) run() {
+    defer Trackers.Done()
+    pending := make(map[string]time.Time)
+    nudged := make(map[string]bool)
+    var latencies []time.Duration
+    var published, unconfirmed uint64
+
+    ticker := time.NewTicker(ConfirmInterval)
+    defer ticker.Stop()
+    for {
+        <-ticker.C
+        blocks, open := t.take()
+        for _, h := range blocks {
+            pending[h.hash] = h.at
+        }
+        published += uint64(len(blocks))
+        if (!open && len(pending) == 0) {
+            break
+        }
+
+        now := time.Now()
+        var batches [][]string
+        batch := make([]string, 0, ConfirmBatch)
+        for hash := range pending {
+            batch = append(batch, hash)
+            if (len(batch) == ConfirmBatch) {
+                batches = append(batches, batch)
+                batch = make([]string, 0, ConfirmBatch)
+            }
+        }
+        if (len(batch) > 0) {
+            batches = append(batches, batch)
+        }
+        for _, confirmed := range parallel(len(batches), func(i int) (map[string]bool) {
+            confirmed, err := GetConfirmed(batches[i])
+            if err != nil {
+                fmt.Println("Error: Unable to poll confirmations:", err)
+            }
+            return confirmed
+        }) {
+            for hash, ok := range confirmed {
+                at, tracked := pending[hash]
+                if (ok && tracked) {
+                    latencies = append(latencies, now.Sub(at))
+                    delete(pending, hash)
+                }
+            }
+        }
+
+        var nudge []string
+        for hash, at := range pending {
+            age := now.Sub(at)
+            if (age > ConfirmTimeout) {
+                delete(pending, hash)
+                delete(nudged, hash)
+                unconfirmed++
+            } else if (age > ConfirmTimeout / 4 && !nudged[hash]) {
+                nudged[hash] = true
+                nudge = append(nudge, hash)
+            }
+        }
+        parallel(len(nudge), func(i int) (map[string]bool) {
+            err := ConfirmBlock(nudge[i])
+            if err != nil {
+                fmt.Println("Error: Unable to start an election for", nudge[i], err)
+            }
+            return nil
+        })
+    }
+
+    report := ConfirmReport{Round: t.round, Published: published, Confirmed: uint64(len(latencies)), Unconfirmed: unconfirmed}
+    if (len(latencies) > 0) {
+        sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+        report.P50 = percentile(latencies, 0.50)
+        report.P90 = percentile(latencies, 0.90)
+        report.P99 = percentile(latencies, 0.99)
+        report.Max = latencies[len(latencies) - 1]
+    }
+    report.Print()
+
+    cLock.Lock()
+    Summary.Confirmed += report.Confirmed
+    Summary.Confirmations = append(Summary.Confirmations, report)
+    cLock.Unlock()
+}
+
+// parallel runs f for 0 to n-1, ConfirmRequests at a time, and returns the
+// results in order.
+func parallel(n int, f func(i int) (map[string]bool)) ([]map[string]bool) {
+    results := make([]map[string]bool, n)
+    slots := make(chan struct{}, ConfirmRequests)
+    var wg sync.WaitGroup
+    for i := 0; i < n; i++ {
+        slots <- struct{}{}
+        wg.Add(1)
+        go func(i int) {
+            defer wg.Done()
+            results[i] = f(i)
+            <-slots
+        }(i)
+    }
+    wg.Wait()
+    return results
+}
+
+// percentile returns the q quantile of sorted latencies.
+func percentile(sorted []time.Duration, q float64) (time.Duration) {
+    i := int(q * float64(len(sorted)) + 0.5) - 1
+    if (i < 0) {
+        i = 0
+    }
+    if (i >= len(sorted)) {
+        i = len(sorted) - 1
+    }
+    return sorted[i]
+}
+
+func (r ConfirmReport) Print() {
+    fmt.Println()
+    fmt.Println("---Confirmations for Round", r.Round, "---")
+    fmt.Println("Published:", r.Published, "Confirmed:", r.Confirmed, "Unconfirmed:", r.Unconfirmed)
+    fmt.Println("Latency p50:", r.P50, "p90:", r.P90, "p99:", r.P99, "max:", r.Max)
+}
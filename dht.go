@@ -0,0 +1,313 @@
+/*
+ * Copyright (C) 2018 Keaton Bruce
+ *
+ * This file is part of nano-prepowtx.
+ *
+ * nano-prepowtx is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * nano-prepowtx is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with nano-prepowtx. If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+    "fmt"
+    "sort"
+    "sync"
+    "bytes"
+    "math/bits"
+    "crypto/rand"
+    "crypto/sha256"
+    "encoding/hex"
+)
+
+/*
+ * Peers are discovered with a small Kademlia DHT. The ID of a node is the
+ * sha256 of its identity key, and the distance between two nodes is the xor
+ * of their IDs. The routing table has a bucket of up to K contacts for every
+ * number of leading bits that an ID shares with ours. Only peers whose
+ * identity was proven by a handshake enter it. A full bucket keeps its
+ * oldest contact while that peer is live, as Kademlia prefers long lived
+ * nodes, and gives its place to the new contact otherwise.
+ *
+ * A lookup for an ID asks the Alpha closest contacts that were not asked yet
+ * for the K contacts they know closest to the ID (find_node), and stops once
+ * the K closest it has heard of were all asked. Every contact that a lookup
+ * finds is added to the peer table, which is how coordination peers are
+ * discovered. Joining is a lookup for our own ID through the seeds, followed
+ * by a lookup for a random ID in every bucket that is still empty.
+ */
+
+const ActionFindNode = "find_node"
+
+// The size of a bucket and of the answer to find_node.
+const K = 8
+// The number of find_node requests of a lookup that run at once.
+const Alpha = 3
+
+const IDBits = 256
+
+type NodeID [sha256.Size]byte
+
+type Contact struct {
+    ID NodeID
+    Address string
+}
+
+// The ID of this node, set with its identity.
+var SelfID NodeID
+
+var routes [IDBits][]Contact
+var dLock sync.Mutex
+
+// nodeID returns the ID of an identity key in hex.
+func nodeID(key string) (NodeID) {
+    b, _ := hex.DecodeString(key)
+    return sha256.Sum256(b)
+}
+
+func (id NodeID) String() (string) {
+    return hex.EncodeToString(id[:8])
+}
+
+// xor returns the distance between two IDs.
+func xor(a, b NodeID) (NodeID) {
+    var d NodeID
+    for i := range a {
+        d[i] = a[i] ^ b[i]
+    }
+    return d
+}
+
+// bucket returns the bucket of an ID, the number of leading bits it shares
+// with ours. Our own ID has none.
+func bucket(id NodeID) (int) {
+    d := xor(SelfID, id)
+    for i, b := range d {
+        if (b != 0) {
+            return i * 8 + bits.LeadingZeros8(b)
+        }
+    }
+    return -1
+}
+
+// routeSeen puts a peer whose identity was proven into the routing table.
+func routeSeen(c *PeerConn) {
+    if (c.key == "" || c.address == "") {
+        return
+    }
+    contact := Contact{nodeID(c.key), c.address}
+    i := bucket(contact.ID)
+    if (i < 0) {
+        return
+    }
+    dLock.Lock()
+    defer dLock.Unlock()
+    b := routes[i]
+    for j, old := range b {
+        if (old.ID == contact.ID) {
+            // Most recently seen at the tail.
+            b = append(b[:j], b[j + 1:]...)
+            routes[i] = append(b, contact)
+            return
+        }
+    }
+    if (len(b) < K) {
+        routes[i] = append(b, contact)
+        return
+    }
+    if (!peerLive(b[0].Address)) {
+        routes[i] = append(b[1:], contact)
+    }
+}
+
+// peerLive reports whether a peer of the peer table answers.
+func peerLive(address string) (bool) {
+    pLock.Lock()
+    defer pLock.Unlock()
+    p, ok := peers[address]
+    return ok && p.live()
+}
+
+// closest returns the n contacts of the routing table closest to an ID.
+func closest(n int, target NodeID) ([]Contact) {
+    dLock.Lock()
+    var contacts []Contact
+    for _, b := range routes {
+        contacts = append(contacts, b...)
+    }
+    dLock.Unlock()
+    sortByDistance(contacts, target)
+    if (len(contacts) > n) {
+        contacts = contacts[:n]
+    }
+    return contacts
+}
+
+func sortByDistance(contacts []Contact, target NodeID) {
+    sort.Slice(contacts, func(i, j int) bool {
+        a := xor(contacts[i].ID, target)
+        b := xor(contacts[j].ID, target)
+        return bytes.Compare(a[:], b[:]) < 0
+    })
+}
+
+// findNode asks a contact for the contacts it knows closest to an ID. A
+// contact with a known ID must have the identity of that ID.
+func findNode(contact Contact, target NodeID) ([]Contact, error) {
+    c, err := dialPeer(contact.Address)
+    if err != nil {
+        return nil, err
+    }
+    defer c.conn.Close()
+    if (contact.ID != (NodeID{}) && nodeID(c.key) != contact.ID) {
+        return nil, fmt.Errorf("%s is not node %s", contact.Address, contact.ID)
+    }
+    if (!c.Capable(ActionFindNode)) {
+        return nil, fmt.Errorf("%s does not handle %s", contact.Address, ActionFindNode)
+    }
+    r, err := c.Call(ActionFindNode, Message{Target: target[:]})
+    if err != nil {
+        return nil, err
+    }
+    return r.Nodes, nil
+}
+
+// lookup returns the K closest contacts to an ID that can be found, starting
+// from the routing table and the extra contacts.
+func lookup(target NodeID, extra ...Contact) ([]Contact) {
+    shortlist := append(closest(K, target), extra...)
+    asked := make(map[string]bool)
+    known := make(map[string]bool)
+    for _, c := range shortlist {
+        known[c.Address] = true
+    }
+    for {
+        var batch []Contact
+        for _, c := range shortlist {
+            if (!asked[c.Address]) {
+                batch = append(batch, c)
+                if (len(batch) == Alpha) {
+                    break
+                }
+            }
+        }
+        if (len(batch) == 0) {
+            break
+        }
+        var wg sync.WaitGroup
+        var rLock sync.Mutex
+        var found []Contact
+        for _, c := range batch {
+            asked[c.Address] = true
+            wg.Add(1)
+            go func(c Contact) {
+                defer wg.Done()
+                nodes, err := findNode(c, target)
+                if err != nil {
+                    fmt.Println("Error: Peer", c.Address, ActionFindNode, err)
+                    return
+                }
+                rLock.Lock()
+                found = append(found, nodes...)
+                rLock.Unlock()
+            }(c)
+        }
+        wg.Wait()
+        for _, c := range found {
+            if (c.ID == SelfID || c.Address == "" || known[c.Address]) {
+                continue
+            }
+            known[c.Address] = true
+            shortlist = append(shortlist, c)
+        }
+        sortByDistance(shortlist, target)
+        if (len(shortlist) > K) {
+            shortlist = shortlist[:K]
+        }
+    }
+    for _, c := range shortlist {
+        receivePeers([]string{c.Address})
+    }
+    return shortlist
+}
+
+// randomID returns a random ID in a bucket.
+func randomID(i int) (NodeID) {
+    var id NodeID
+    rand.Read(id[:])
+    // Share the first i bits with our ID and differ in the next one.
+    for b := 0; b <= i; b++ {
+        mask := byte(0x80) >> uint(b % 8)
+        bit := SelfID[b / 8] & mask
+        if (b == i) {
+            bit ^= mask
+        }
+        id[b / 8] = (id[b / 8] &^ mask) | bit
+    }
+    return id
+}
+
+// joinDHT looks up our own ID through the seeds, then refreshes the buckets
+// that are still empty.
+func joinDHT(seeds []string) {
+    var extra []Contact
+    for _, seed := range seeds {
+        extra = append(extra, Contact{Address: seed})
+    }
+    lookup(SelfID, extra...)
+    refreshDHT()
+}
+
+// refreshDHT looks up a random ID in every empty bucket below the deepest
+// bucket that has contacts.
+func refreshDHT() {
+    dLock.Lock()
+    deepest := -1
+    var empty []int
+    for i, b := range routes {
+        if (len(b) > 0) {
+            deepest = i
+        }
+    }
+    for i := 0; i < deepest; i++ {
+        if (len(routes[i]) == 0) {
+            empty = append(empty, i)
+        }
+    }
+    dLock.Unlock()
+    for _, i := range empty {
+        lookup(randomID(i))
+    }
+}
+
+func handleFindNode(c *PeerConn, m Message) (Message) {
+    if (len(m.Target) != len(NodeID{})) {
+        return protocolError(ErrCodeBadRequest, "find_node without a target")
+    }
+    var target NodeID
+    copy(target[:], m.Target)
+    return Message{Header: Header{Action: ActionFindNode}, Nodes: closest(K, target)}
+}
+
+// printRoutes prints the routing table.
+func printRoutes() {
+    fmt.Println("---Routing Table of Node", SelfID, "---")
+    dLock.Lock()
+    defer dLock.Unlock()
+    for i, b := range routes {
+        for _, c := range b {
+            fmt.Println("Bucket:", i, "Node:", c.ID, "Address:", c.Address)
+        }
+    }
+}
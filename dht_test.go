@@ -0,0 +1,137 @@
+/*
+ * Copyright (C) 2018 Keaton Bruce
+ *
+ * This file is part of nano-prepowtx.
+ *
+ * nano-prepowtx is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * nano-prepowtx is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with nano-prepowtx. If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+    "os"
+    "fmt"
+    "net"
+    "time"
+    "bytes"
+    "strings"
+    "testing"
+    "os/exec"
+    "path/filepath"
+)
+
+func TestRandomIDBucket(t *testing.T) {
+    SelfID = nodeID(strings.Repeat("ab", 32))
+    for i := 0; i < IDBits; i++ {
+        if b := bucket(randomID(i)); (b != i) {
+            t.Fatalf("randomID(%d) is in bucket %d", i, b)
+        }
+    }
+    if (bucket(SelfID) != -1) {
+        t.Fatalf("our own ID has a bucket")
+    }
+}
+
+// The number of instances of the loopback cluster. More than enough to have
+// been rate limited by the seed when the limits were by host.
+const LoopbackInstances = 16
+
+// TestLoopbackCluster starts a cluster of -peer_only instances on loopback
+// that all join through the first one, and checks that every instance found
+// the others without being rate limited. It takes a round of maintenance.
+func TestLoopbackCluster(t *testing.T) {
+    if (testing.Short()) {
+        t.Skip("starts a cluster of processes for more than PingInterval")
+    }
+    dir := t.TempDir()
+    bin := filepath.Join(dir, "node")
+    build := exec.Command("go", "build", "-o", bin, ".")
+    if out, err := build.CombinedOutput(); err != nil {
+        t.Fatalf("go build: %v\n%s", err, out)
+    }
+
+    addresses := make([]string, LoopbackInstances)
+    for i := range addresses {
+        ln, err := net.Listen("tcp", "127.0.0.1:0")
+        if err != nil {
+            t.Fatal(err)
+        }
+        addresses[i] = ln.Addr().String()
+        ln.Close()
+    }
+
+    cmds := make([]*exec.Cmd, LoopbackInstances)
+    outs := make([]*bytes.Buffer, LoopbackInstances)
+    for i := range cmds {
+        args := []string{"-peer_only", "-listen", addresses[i], "-cluster_secret", "loopback",
+            "-identity", filepath.Join(dir, fmt.Sprint(i, ".key")), "-peer_file", ""}
+        if (i > 0) {
+            args = append(args, "-peers", addresses[0])
+        }
+        outs[i] = &bytes.Buffer{}
+        cmds[i] = exec.Command(bin, args...)
+        cmds[i].Stdout = outs[i]
+        cmds[i].Stderr = outs[i]
+        if err := cmds[i].Start(); err != nil {
+            t.Fatal(err)
+        }
+        if (i == 0) {
+            // The seed listens before anyone joins.
+            time.Sleep(500 * time.Millisecond)
+        }
+    }
+    defer func() {
+        for _, cmd := range cmds {
+            cmd.Process.Kill()
+        }
+    }()
+
+    time.Sleep(PingInterval + 10 * time.Second)
+    for _, cmd := range cmds {
+        cmd.Process.Signal(os.Interrupt)
+    }
+    for i, cmd := range cmds {
+        done := make(chan error, 1)
+        go func() { done <- cmd.Wait() }()
+        select {
+        case err := <-done:
+            if err != nil {
+                t.Fatalf("instance %d: %v\n%s", i, err, outs[i])
+            }
+        case <-time.After(30 * time.Second):
+            t.Fatalf("instance %d did not stop", i)
+        }
+    }
+
+    for i, out := range outs {
+        s := out.String()
+        if (strings.Contains(s, ErrRateLimited.Error())) {
+            t.Errorf("instance %d was rate limited:\n%s", i, s)
+        }
+        known := make(map[string]bool)
+        for _, line := range strings.Split(s, "\n") {
+            if f := strings.Fields(line); (len(f) == 6 && f[0] == "Bucket:") {
+                known[f[5]] = true
+            }
+        }
+        if (known[addresses[i]]) {
+            t.Errorf("instance %d routes to itself", i)
+        }
+        // Every other instance fits into the buckets of K.
+        if (len(known) < K) {
+            t.Errorf("instance %d knows %d of %d instances:\n%s", i, len(known), LoopbackInstances - 1, s)
+        }
+    }
+}
@@ -0,0 +1,176 @@
+/*
+ * Copyright (C) 2018 Keaton Bruce
+ *
+ * This file is part of nano-prepowtx.
+ *
+ * nano-prepowtx is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * nano-prepowtx is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with nano-prepowtx. If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+    "fmt"
+    "os"
+    "strconv"
+    "context"
+)
+
+/*
+ * Precomputed work can go stale. The threshold for a block may be raised
+ * between computing and publishing it, either by an epoch upgrade (which gives
+ * sends and receives different thresholds) or by the active difficulty rising
+ * while the network is under load.
+ *
+ * The difficulty of every block is recorded when it is created and checked
+ * against the WorkPolicy right before publishing. Blocks under the threshold
+ * get new work, which does not require signing them again.
+ *
+ * Without -send_difficulty, -receive_difficulty or -active_difficulty nothing
+ * is checked and the node is not asked about difficulties at all. An error of
+ * the node while checking leaves the blocks as they are.
+ */
+
+type WorkPolicy struct {
+    // The thresholds per block subtype. Zero means the network minimum.
+    Send uint64
+    Receive uint64
+    // Follow the current active difficulty of the network when it is higher.
+    Active bool
+}
+
+var Policy WorkPolicy
+
+// Enabled reports whether blocks are checked against the policy.
+func (p WorkPolicy) Enabled() (bool) {
+    return p.Send != 0 || p.Receive != 0 || p.Active
+}
+
+// ParseDifficulty reads a difficulty as the node reports it, in hex.
+// An empty string is an unknown difficulty and returns zero.
+func ParseDifficulty(s string) (uint64) {
+    if (s == "") {
+        return 0
+    }
+    d, err := strconv.ParseUint(s, 16, 64)
+    if err != nil {
+        fmt.Println("Error: Invalid difficulty", s)
+        os.Exit(1)
+    }
+    return d
+}
+
+func FormatDifficulty(d uint64) (string) {
+    return fmt.Sprintf("%016x", d)
+}
+
+// BlockDifficulty returns the difficulty of the work of a block. The node
+// is asked to validate the work if block_create did not report it and the
+// blocks are checked. Zero is an unknown difficulty.
+func BlockDifficulty(p *PackedBlock, difficulty string) (uint64) {
+    if (difficulty != "") {
+        return ParseDifficulty(difficulty)
+    }
+    if (!Policy.Enabled()) {
+        return 0
+    }
+    difficulty, err := ValidateWork(p.WorkString(), p.PreviousString())
+    if err != nil {
+        fmt.Println("Error: Unable to validate the work of", p.HashString(), err)
+        return 0
+    }
+    return ParseDifficulty(difficulty)
+}
+
+// Threshold returns the difficulty required for a block of the subtype.
+func (p WorkPolicy) Threshold(subtype string, minimum, current uint64) (uint64) {
+    threshold := p.Receive
+    if (subtype == "send") {
+        threshold = p.Send
+    }
+    if (threshold < minimum) {
+        threshold = minimum
+    }
+    if (p.Active && threshold < current) {
+        threshold = current
+    }
+    return threshold
+}
+
+// ReworkBlocks gives new work to every block that is below the threshold of
+// its subtype, until the context is done. Returns the number of blocks that
+// were reworked.
+func ReworkBlocks(ctx context.Context, a *Arena) (uint64) {
+    if (!Policy.Enabled()) {
+        return 0
+    }
+    networkMinimum, networkCurrent, err := ActiveDifficulty()
+    if (err != nil && Policy.Active) {
+        fmt.Println("Error: Unable to get the active difficulty, the blocks are not reworked:", err)
+        return 0
+    }
+    if err != nil {
+        // The thresholds of the policy are still known.
+        fmt.Println("Error: Unable to get the active difficulty:", err)
+    }
+    minimum := ParseDifficulty(networkMinimum)
+    current := ParseDifficulty(networkCurrent)
+
+    var reworked, unknown, failed uint64
+    for i := uint64(0); i < a.Len(); i++ {
+        if (ctx.Err() != nil) {
+            fmt.Println("\n---Stopped Reworking at Block", i, "of", a.Len(), "---")
+            break
+        }
+        p := a.Get(i)
+        if (p.Difficulty == 0) {
+            // The node never told us, so there is nothing to compare.
+            unknown++
+            continue
+        }
+        threshold := Policy.Threshold(p.Subtype(), minimum, current)
+        if (p.Difficulty >= threshold) {
+            continue
+        }
+
+        fmt.Print("\rReworking Block: ", p.HashString(), "   \r")
+        work, difficulty, err := GenerateWork(p.PreviousString(), FormatDifficulty(threshold))
+        var w uint64
+        if err == nil {
+            w, err = strconv.ParseUint(work, 16, 64)
+        }
+        if err != nil {
+            // Published as it is, the node may still take it.
+            fmt.Println("Error: Unable to rework", p.HashString(), err)
+            failed++
+            continue
+        }
+        p.Work = w
+        p.Difficulty = ParseDifficulty(difficulty)
+        if (p.Difficulty == 0) {
+            p.Difficulty = threshold
+        }
+        reworked++
+    }
+    if (unknown > 0) {
+        fmt.Println("Unknown work difficulty for", unknown, "blocks, they were not checked")
+    }
+    if (reworked > 0) {
+        fmt.Println("Reworked", reworked, "blocks below the work threshold")
+    }
+    if (failed > 0) {
+        fmt.Println("Unable to rework", failed, "blocks below the work threshold")
+    }
+    return reworked
+}
@@ -0,0 +1,162 @@
+/*
+ * Copyright (C) 2018 Keaton Bruce
+ *
+ * This file is part of nano-prepowtx.
+ *
+ * nano-prepowtx is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * nano-prepowtx is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with nano-prepowtx. If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+    "fmt"
+    "math/big"
+    "time"
+)
+
+/*
+ * A dry run plans a campaign without changing the ledger or the wallet.
+ * It only reads the wallet (account_list, wallet_balances) and the richest
+ * account (account_info). How many blocks a round can precompute is estimated
+ * from an assumed time for the work of a block. Only with -measure_pow is
+ * work_generate timed on the frontier of the richest account instead, which
+ * keeps the node busy but does not change anything either.
+ */
+
+// The number of work_generate requests to time.
+const DryRunSamples = 3
+
+// The time assumed for the work of a block, about what a CPU takes.
+const DryRunPoWTime = 5 * time.Second
+
+func dryRun(schedule Schedule, perBlock time.Duration, measure bool) {
+    fmt.Println("---Dry Run (Nothing Is Sent or Created)---")
+
+    // ACCOUNTS
+    accounts := AccountList()
+    nWalletAccounts := countAccounts(accounts)
+    accounts = accounts[:nWalletAccounts]
+    fmt.Println("Wallet Accounts Used:", nWalletAccounts)
+    fmt.Println("Accounts To Generate:", NAccounts - nWalletAccounts)
+
+    // FUNDS
+    balances := GetBalances()
+    total := big.NewInt(0)
+    max := big.NewInt(0)
+    var nMax uint64
+    funds := make([]*big.Int, NAccounts)
+    for i := uint64(0); i < NAccounts; i++ {
+        funds[i] = big.NewInt(0)
+        if (i < nWalletAccounts) {
+            funds[i].SetString(balances[accounts[i]].Balance, 10)
+        }
+        if (funds[i].Cmp(max) > 0) {
+            max.Set(funds[i])
+            nMax = i
+        }
+        total.Add(total, funds[i])
+    }
+    fmt.Println("Total Balance:", total, "raw")
+
+    minimum := big.NewInt(100000)
+    if (total.Cmp(minimum) < 0) {
+        fmt.Println("Insufficient funds: you need at least", minimum, "raw. You have", total, "raw.")
+        return
+    }
+
+    amount := big.NewInt(int64(DefaultTPA))
+    funding := big.NewInt(0)
+    var transfers uint64
+    if (max.Cmp(minimum) >= 0) {
+        for k := uint64(0); k < NAccounts; k++ {
+            if (funds[k].Cmp(amount) >= 0) {
+                continue
+            }
+            deficit := new(big.Int).Sub(amount, funds[k])
+            name := fmt.Sprint("(generated account ", k, ")")
+            if (k < nWalletAccounts) {
+                name = accounts[k]
+            }
+            fmt.Println("Fund:", name, "with", deficit, "raw from", accounts[nMax])
+            funding.Add(funding, deficit)
+            transfers++
+        }
+    }
+    fmt.Println("Funding Transfers:", transfers, "Total:", funding, "raw")
+
+    // PRECOMPUTE
+    if (measure) {
+        info := AccountInfo(accounts[nMax])
+        var elapsed time.Duration
+        for i := 0; i < DryRunSamples; i++ {
+            start := time.Now()
+            _, _, err := GenerateWork(info.Frontier, "")
+            if err != nil {
+                fmt.Println("Error: Unable to time work_generate:", err)
+                return
+            }
+            elapsed += time.Since(start)
+        }
+        perBlock = elapsed / DryRunSamples
+        fmt.Println("Measured PoW Time:", perBlock, "per block")
+    } else {
+        fmt.Println("Assumed PoW Time:", perBlock, "per block (-measure_pow times the node)")
+    }
+    if (perBlock <= 0) {
+        perBlock = time.Nanosecond
+    }
+
+    blocks := uint64(schedule.Interval / perBlock)
+    if (Target > 0 && Target < blocks) {
+        blocks = Target
+    }
+    sends := blocks
+    if (Pipeline) {
+        // Every send is followed by a receive.
+        sends = blocks / 2
+    }
+    fmt.Println("Expected Blocks per Round:", blocks)
+    if (Pipeline) {
+        fmt.Println("Expected Sends per Round:", sends)
+    } else {
+        fmt.Println("Expected Sends per Send Round:", sends, "(receive rounds alternate with send rounds)")
+    }
+    fmt.Printf("Expected TPS over the Campaign: %.2f\n", float64(blocks) / schedule.Interval.Seconds())
+    if (Profile != nil) {
+        fmt.Printf("Expected TPS while Publishing: %.2f (load profile over %s)\n", float64(blocks) / Profile.Length().Seconds(), Profile.Length())
+    } else if (Limiter != nil) {
+        fmt.Printf("Expected TPS while Publishing: %.2f\n", Limiter.Rate())
+    } else {
+        fmt.Println("Expected TPS while Publishing: as fast as the node accepts blocks")
+    }
+
+    // SPENT
+    spent := new(big.Int).Mul(Amount, new(big.Int).SetUint64(sends))
+    rounds := schedule.Rounds
+    if (rounds == 0 && schedule.Duration > 0) {
+        rounds = int64(schedule.Duration / schedule.Interval)
+    }
+    if (rounds > 0) {
+        sendRounds := rounds
+        if (!Pipeline) {
+            sendRounds = (rounds + 1) / 2
+        }
+        spent.Mul(spent, big.NewInt(sendRounds))
+        fmt.Println("Expected Rounds:", rounds)
+        fmt.Println("Total Raw Sent:", spent, "raw")
+    } else {
+        fmt.Println("Raw Sent per Send Round:", spent, "raw (the campaign runs until stopped)")
+    }
+}
@@ -0,0 +1,153 @@
+/*
+ * Copyright (C) 2018 Keaton Bruce
+ *
+ * This file is part of nano-prepowtx.
+ *
+ * nano-prepowtx is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * nano-prepowtx is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with nano-prepowtx. If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+    "fmt"
+    "os"
+    "sync"
+    "strings"
+    "time"
+)
+
+/*
+ * Blocks can be published to several nano-nodes to measure how they
+ * propagate. The fan-out decides which nodes get a block:
+ *
+ * round_robin - every block goes to the next node.
+ * pin         - every account always publishes to the same node.
+ * broadcast   - every block goes to every node at the same time.
+ *
+ * The acceptance and latency of every node are counted separately.
+ */
+
+type Endpoint struct {
+    URL string
+    Published uint64
+    Outcomes OutcomeCounts
+    // The total and the highest latency of the process requests.
+    Latency time.Duration
+    MaxLatency time.Duration
+}
+
+// The endpoints that blocks are published to, in the order of Nodes.
+var Endpoints []*Endpoint
+
+var Fanout string
+
+func setupEndpoints(list []string, fanout string) {
+    var urls []string
+    for _, url := range list {
+        if url = strings.TrimSpace(url); (url != "") {
+            urls = append(urls, url)
+        }
+    }
+    if (len(urls) == 0) {
+        fmt.Println("Error: No RPC endpoints were provided.")
+        os.Exit(1)
+    }
+    switch fanout {
+    case "round_robin", "pin", "broadcast":
+    default:
+        fmt.Println("Error: Unknown fan-out:", fanout)
+        os.Exit(1)
+    }
+    Nodes = urls
+    Fanout = fanout
+    Endpoints = make([]*Endpoint, len(urls))
+    for i, url := range urls {
+        Endpoints[i] = &Endpoint{URL: url}
+    }
+}
+
+// endpointsFor returns the endpoints that the i-th block of a round is published to.
+func endpointsFor(i uint64, account uint32) ([]*Endpoint) {
+    n := uint64(len(Endpoints))
+    switch Fanout {
+    case "pin":
+        return Endpoints[uint64(account) % n:uint64(account) % n + 1]
+    case "broadcast":
+        return Endpoints
+    }
+    return Endpoints[i % n:i % n + 1]
+}
+
+// publish sends a block to a single endpoint and counts the outcome.
+func (e *Endpoint) publish(blk string) (Outcome) {
+    start := time.Now()
+    _, rejected, err := PublishBlock(e.URL, blk)
+    latency := time.Since(start)
+
+    e.Published++
+    e.Latency += latency
+    if (latency > e.MaxLatency) {
+        e.MaxLatency = latency
+    }
+    o := Classify(rejected, err)
+    e.Outcomes[o]++
+    if err != nil {
+        fmt.Println("\nError:", e.URL, err)
+    } else if (o == OtherError) {
+        fmt.Println("\nError:", e.URL, rejected)
+    }
+    return o
+}
+
+// publishBlock sends the i-th block of a round to the endpoints of the fan-out.
+// The block makes progress if any endpoint accepted it, otherwise the outcome
+// of the first endpoint is returned.
+func publishBlock(i uint64, p *PackedBlock) (Outcome) {
+    blk := p.JSON()
+    endpoints := endpointsFor(i, p.Account)
+    if (len(endpoints) == 1) {
+        return endpoints[0].publish(blk)
+    }
+
+    var wg sync.WaitGroup
+    outcomes := make([]Outcome, len(endpoints))
+    for j, e := range endpoints {
+        wg.Add(1)
+        go func(j int, e *Endpoint) {
+            defer wg.Done()
+            outcomes[j] = e.publish(blk)
+        }(j, e)
+    }
+    wg.Wait()
+    for _, o := range outcomes {
+        if (o == Progress) {
+            return Progress
+        }
+    }
+    return outcomes[0]
+}
+
+func printEndpoints() {
+    fmt.Println("---Endpoint Statistics---")
+    for _, e := range Endpoints {
+        var average time.Duration
+        if (e.Published > 0) {
+            average = e.Latency / time.Duration(e.Published)
+        }
+        fmt.Println(e.URL, "Published:", e.Published, "Accepted:", e.Outcomes[Progress],
+            "Average Latency:", average, "Max Latency:", e.MaxLatency)
+        fmt.Println("    Outcomes:", e.Outcomes)
+    }
+}
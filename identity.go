@@ -0,0 +1,237 @@
+/*
+ * Copyright (C) 2018 Keaton Bruce
+ *
+ * This file is part of nano-prepowtx.
+ *
+ * nano-prepowtx is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * nano-prepowtx is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with nano-prepowtx. If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+    "fmt"
+    "os"
+    "sync"
+    "time"
+    "bytes"
+    "errors"
+    "strings"
+    "io/ioutil"
+    "crypto/ed25519"
+    "crypto/hmac"
+    "crypto/rand"
+    "crypto/sha256"
+    "encoding/binary"
+    "encoding/gob"
+    "encoding/hex"
+)
+
+/*
+ * Every instance has an ed25519 identity, kept in a key file and created on
+ * the first run. Every Message is sent in a Frame that is signed with it:
+ *
+ *     signature = sign(payload | key | nonce | time)
+ *
+ * A peer is accepted when its key is on the allowlist, or when the frame also
+ * carries an HMAC-SHA256 of the same bytes with the shared cluster secret.
+ * Without either no peer is accepted, so an instance does not start to talk
+ * to peers without one. Unsigned frames are rejected. A frame is only
+ * accepted once: its time must be within ReplayWindow of ours and its nonce
+ * must not have been seen from the same key within the window. The nonces
+ * are kept in the order they arrived, so the expired ones are dropped from
+ * the front.
+ */
+
+// Frames further off in time are rejected.
+const ReplayWindow = 5 * time.Minute
+
+// A Message, signed by the identity of the sender.
+type Frame struct {
+    Payload []byte
+    Key []byte
+    Nonce uint64
+    Time int64
+    Signature []byte
+    // HMAC with the cluster secret, if there is one.
+    MAC []byte
+}
+
+var Identity ed25519.PrivateKey
+
+// The public keys of the accepted peers, in hex.
+var Allowed = make(map[string]bool)
+var ClusterSecret []byte
+
+type seenNonce struct {
+    id string
+    at time.Time
+}
+
+// The nonces that were seen within the replay window, by key and nonce, and
+// in the order they arrived.
+var seen = make(map[string]bool)
+var seenOrder []seenNonce
+var sLock sync.Mutex
+
+var ErrUnsigned = errors.New("the frame is not signed")
+var ErrBadSignature = errors.New("the frame has a bad signature")
+var ErrNotAllowed = errors.New("the key is not allowed")
+var ErrReplayed = errors.New("the frame was replayed or is too old")
+
+// loadIdentity reads the identity from a key file, or creates it.
+func loadIdentity(path string) {
+    b, err := ioutil.ReadFile(path)
+    if os.IsNotExist(err) {
+        _, Identity, err = ed25519.GenerateKey(rand.Reader)
+        if err == nil {
+            err = ioutil.WriteFile(path, []byte(hex.EncodeToString(Identity.Seed()) + "\n"), 0600)
+        }
+        if err != nil {
+            fmt.Println("Error: Unable to create the identity:", err)
+            os.Exit(1)
+        }
+        fmt.Println("Created Identity:", path)
+    } else {
+        var seed []byte
+        if err == nil {
+            seed, err = hex.DecodeString(strings.TrimSpace(string(b)))
+        }
+        if (err == nil && len(seed) != ed25519.SeedSize) {
+            err = errors.New("the key file does not hold an ed25519 seed")
+        }
+        if err != nil {
+            fmt.Println("Error: Unable to read the identity:", err)
+            os.Exit(1)
+        }
+        Identity = ed25519.NewKeyFromSeed(seed)
+    }
+    SelfID = nodeID(NodeKey())
+    fmt.Println("Node Identity:", NodeKey())
+}
+
+// NodeKey returns the public key of this node in hex.
+func NodeKey() (string) {
+    return hex.EncodeToString(Identity.Public().(ed25519.PublicKey))
+}
+
+// setupTrust reads the allowlist of keys and the cluster secret.
+func setupTrust(allow, secret string) {
+    for _, key := range strings.Split(allow, ",") {
+        key = strings.ToLower(strings.TrimSpace(key))
+        if (key == "") {
+            continue
+        }
+        b, err := hex.DecodeString(key)
+        if (err != nil || len(b) != ed25519.PublicKeySize) {
+            fmt.Println("Error: Invalid public key on the allowlist:", key)
+            os.Exit(1)
+        }
+        Allowed[key] = true
+    }
+    if (secret != "") {
+        ClusterSecret = []byte(secret)
+    }
+    if (len(Allowed) == 0 && ClusterSecret == nil) {
+        fmt.Println("Error: Peers need an allowlist (-allow) or a cluster secret (-cluster_secret)")
+        os.Exit(1)
+    }
+}
+
+// signed returns the bytes that are signed for a frame.
+func (f *Frame) signed() ([]byte) {
+    var b bytes.Buffer
+    b.Write(f.Payload)
+    b.Write(f.Key)
+    binary.Write(&b, binary.BigEndian, f.Nonce)
+    binary.Write(&b, binary.BigEndian, f.Time)
+    return b.Bytes()
+}
+
+func mac(b []byte) ([]byte) {
+    h := hmac.New(sha256.New, ClusterSecret)
+    h.Write(b)
+    return h.Sum(nil)
+}
+
+// seal signs a Message into a Frame.
+func seal(m Message) (Frame, error) {
+    var payload bytes.Buffer
+    err := gob.NewEncoder(&payload).Encode(m)
+    if err != nil {
+        return Frame{}, err
+    }
+    var nonce [8]byte
+    _, err = rand.Read(nonce[:])
+    if err != nil {
+        return Frame{}, err
+    }
+    f := Frame{Payload: payload.Bytes(), Key: Identity.Public().(ed25519.PublicKey), Nonce: binary.BigEndian.Uint64(nonce[:]), Time: time.Now().UnixNano()}
+    b := f.signed()
+    f.Signature = ed25519.Sign(Identity, b)
+    if (ClusterSecret != nil) {
+        f.MAC = mac(b)
+    }
+    return f, nil
+}
+
+// unseal checks a Frame and returns its Message and the key of the sender in hex.
+func unseal(f Frame) (Message, string, error) {
+    if (len(f.Signature) == 0 || len(f.Key) == 0) {
+        return Message{}, "", ErrUnsigned
+    }
+    if (len(f.Key) != ed25519.PublicKeySize) {
+        return Message{}, "", ErrBadSignature
+    }
+    b := f.signed()
+    if (!ed25519.Verify(ed25519.PublicKey(f.Key), b, f.Signature)) {
+        return Message{}, "", ErrBadSignature
+    }
+    key := hex.EncodeToString(f.Key)
+    byKey := Allowed[key]
+    bySecret := ClusterSecret != nil && hmac.Equal(f.MAC, mac(b))
+    if (!byKey && !bySecret) {
+        return Message{}, key, ErrNotAllowed
+    }
+    if (!fresh(key, f.Nonce, time.Unix(0, f.Time))) {
+        return Message{}, key, ErrReplayed
+    }
+    var m Message
+    err := gob.NewDecoder(bytes.NewReader(f.Payload)).Decode(&m)
+    return m, key, err
+}
+
+// fresh reports whether a nonce is new and its time within the window, and
+// remembers it.
+func fresh(key string, nonce uint64, at time.Time) (bool) {
+    now := time.Now()
+    if (at.Before(now.Add(-ReplayWindow)) || at.After(now.Add(ReplayWindow))) {
+        return false
+    }
+    sLock.Lock()
+    defer sLock.Unlock()
+    // A frame is at most ReplayWindow ahead of when it arrived, so its
+    // nonce can be forgotten 2 * ReplayWindow after that.
+    for (len(seenOrder) > 0 && seenOrder[0].at.Before(now.Add(-2 * ReplayWindow))) {
+        delete(seen, seenOrder[0].id)
+        seenOrder = seenOrder[1:]
+    }
+    id := fmt.Sprint(key, ":", nonce)
+    if (seen[id]) {
+        return false
+    }
+    seen[id] = true
+    seenOrder = append(seenOrder, seenNonce{id, now})
+    return true
+}
@@ -0,0 +1,163 @@
+/*
+ * Copyright (C) 2018 Keaton Bruce
+ *
+ * This file is part of nano-prepowtx.
+ *
+ * nano-prepowtx is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * nano-prepowtx is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with nano-prepowtx. If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+    "time"
+    "testing"
+    "crypto/rand"
+    "crypto/ed25519"
+    "encoding/hex"
+)
+
+// newIdentity returns a new identity and its key in hex.
+func newIdentity(t testing.TB) (ed25519.PrivateKey, string) {
+    public, private, err := ed25519.GenerateKey(rand.Reader)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return private, hex.EncodeToString(public)
+}
+
+// trust sets up the identity of this node, the allowlist and the cluster
+// secret for a test.
+func trust(identity ed25519.PrivateKey, secret string, allowed ...string) {
+    Identity = identity
+    Allowed = make(map[string]bool)
+    for _, key := range allowed {
+        Allowed[key] = true
+    }
+    ClusterSecret = nil
+    if (secret != "") {
+        ClusterSecret = []byte(secret)
+    }
+    seen = make(map[string]bool)
+    seenOrder = nil
+}
+
+func mustSeal(t *testing.T, m Message) (Frame) {
+    f, err := seal(m)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return f
+}
+
+func TestUnseal(t *testing.T) {
+    self, selfKey := newIdentity(t)
+    other, _ := newIdentity(t)
+    hello := Message{Header: Header{Action: ActionHello, ID: 3}}
+
+    trust(self, "", selfKey)
+    f := mustSeal(t, hello)
+    m, key, err := unseal(f)
+    if (err != nil || key != selfKey || m.Header != hello.Header) {
+        t.Fatalf("unseal = %+v, %s, %v", m.Header, key, err)
+    }
+    if _, _, err := unseal(f); (err != ErrReplayed) {
+        t.Fatalf("a replayed frame: %v, want %v", err, ErrReplayed)
+    }
+
+    unsigned := mustSeal(t, hello)
+    unsigned.Signature = nil
+    if _, _, err := unseal(unsigned); (err != ErrUnsigned) {
+        t.Fatalf("an unsigned frame: %v, want %v", err, ErrUnsigned)
+    }
+    tampered := mustSeal(t, hello)
+    tampered.Payload[len(tampered.Payload) - 1] ^= 1
+    if _, _, err := unseal(tampered); (err != ErrBadSignature) {
+        t.Fatalf("a tampered frame: %v, want %v", err, ErrBadSignature)
+    }
+    forged := mustSeal(t, hello)
+    forged.Signature = ed25519.Sign(other, forged.signed())
+    if _, _, err := unseal(forged); (err != ErrBadSignature) {
+        t.Fatalf("a frame signed by another key: %v, want %v", err, ErrBadSignature)
+    }
+
+    // Signed correctly by an identity that is not on the allowlist.
+    trust(other, "", selfKey)
+    stranger := mustSeal(t, hello)
+    if _, _, err := unseal(stranger); (err != ErrNotAllowed) {
+        t.Fatalf("a signer outside the allowlist: %v, want %v", err, ErrNotAllowed)
+    }
+
+    // Anyone who knows the cluster secret, and only them.
+    trust(other, "secret")
+    if _, _, err := unseal(mustSeal(t, hello)); err != nil {
+        t.Fatalf("a frame with the cluster secret: %v", err)
+    }
+    trust(other, "wrong")
+    wrong := mustSeal(t, hello)
+    trust(other, "secret")
+    if _, _, err := unseal(wrong); (err != ErrNotAllowed) {
+        t.Fatalf("a frame with the wrong secret: %v, want %v", err, ErrNotAllowed)
+    }
+    trust(other, "")
+    plain := mustSeal(t, hello)
+    trust(other, "secret")
+    if _, _, err := unseal(plain); (err != ErrNotAllowed) {
+        t.Fatalf("a frame without the secret: %v, want %v", err, ErrNotAllowed)
+    }
+
+    old := mustSeal(t, hello)
+    old.Time = time.Now().Add(-2 * ReplayWindow).UnixNano()
+    old.Signature = ed25519.Sign(other, old.signed())
+    old.MAC = mac(old.signed())
+    if _, _, err := unseal(old); (err != ErrReplayed) {
+        t.Fatalf("a frame from outside the window: %v, want %v", err, ErrReplayed)
+    }
+}
+
+// The nonces are forgotten in the order they arrived, once they are too old
+// to be accepted again.
+func TestNonceExpiry(t *testing.T) {
+    self, selfKey := newIdentity(t)
+    trust(self, "", selfKey)
+    now := time.Now()
+    for nonce := uint64(1); nonce <= 3; nonce++ {
+        if (!fresh(selfKey, nonce, now)) {
+            t.Fatalf("nonce %d was not fresh", nonce)
+        }
+    }
+    if (fresh(selfKey, 2, now)) {
+        t.Fatalf("nonce 2 was accepted twice")
+    }
+    // The first two arrived long enough ago.
+    for i := 0; i < 2; i++ {
+        seenOrder[i].at = now.Add(-2 * ReplayWindow - time.Second)
+    }
+    if (!fresh(selfKey, 4, now)) {
+        t.Fatalf("nonce 4 was not fresh")
+    }
+    if (len(seenOrder) != 2 || len(seen) != 2 || seenOrder[0].id != selfKey + ":3" || seenOrder[1].id != selfKey + ":4") {
+        t.Fatalf("seen %v in order %v", seen, seenOrder)
+    }
+    if (!fresh(selfKey, 1, now) || fresh(selfKey, 3, now)) {
+        t.Fatalf("the nonces did not expire in order")
+    }
+
+    // An old nonce behind a newer one waits for it.
+    seenOrder[len(seenOrder) - 1].at = now.Add(-2 * ReplayWindow - time.Second)
+    fresh(selfKey, 5, now)
+    if (!seen[selfKey + ":1"]) {
+        t.Fatalf("a nonce expired before the ones that arrived earlier")
+    }
+}
@@ -22,17 +22,14 @@ package main
 
 import (
     "fmt"
-    "net"
+    "context"
+    "errors"
     "strings"
-    "encoding/gob"
-    "sync"
-    "log"
     "flag"
     "os"
     "math"
     "math/big"
     "time"
-    "strconv"
 )
 
 /*
@@ -59,33 +56,128 @@ var Total *big.Int
 var DefaultTPA uint64
 
 // The most recent block for every account.
-var Hashes [][]string
+// The blocks themselves are stored in the Round arena.
+var Frontiers []string
 
-// Blks will store all of the blocks that are created and signed offline.
-// For each account, store a slice of blocks, in order.
-// blks[account][block]
-var Blks [][]string
+// The number of blocks that were precomputed for every account.
+var Heights []uint64
 
 // The time interval to the next attack measured in seconds.
 var tCompute int64
 var LastPoWMax uint64
 
+// The number of blocks to precompute every round, zero precomputes until the attack.
+var Target uint64
+
+// The amount of raw of every precomputed send.
+var Amount = big.NewInt(1)
+
+// Pipeline mixes sends and receives in every round instead of alternating rounds.
+var Pipeline bool
+
 // var Uid *big.Int
 
 func main() {
     wallet := flag.String("wallet", "", "The wallet to sign/verify blocks")
     nAccounts := flag.Uint64("n_accounts", 100, "The number of accounts to user/generate")
+    network := flag.String("network", "live", "The network that the node and the blocks belong to")
+    export := flag.String("export", "", "Precompute a single round and write it to this bundle file instead of publishing")
+    publish := flag.String("publish", "", "Publish the blocks of this bundle file and exit")
+    sendDifficulty := flag.String("send_difficulty", "", "The minimum work difficulty for send blocks, in hex")
+    receiveDifficulty := flag.String("receive_difficulty", "", "The minimum work difficulty for receive blocks, in hex")
+    activeDifficulty := flag.Bool("active_difficulty", false, "Rework blocks to the active difficulty of the network before publishing")
+    topology := flag.String("topology", "ring", "Who sends to whom: ring, star, fan_in, fan_out, random or mesh")
+    hub := flag.Uint64("hub", 0, "The hub account of the star, fan_in and fan_out topologies")
+    seed := flag.Uint64("seed", 1, "The seed of the random topology")
+    pipeline := flag.Bool("pipeline", false, "Precompute sends and the receives of earlier sends in every round")
+    interval := flag.Duration("interval", 5 * time.Minute, "The time to precompute a round of blocks before every attack")
+    start := flag.String("start", "", "The time of the first attack, in RFC 3339 (default aligns attacks to the interval)")
+    rounds := flag.Int64("rounds", 0, "The number of rounds to run in this process, also when resuming, 0 runs forever")
+    duration := flag.Duration("duration", 0, "The total duration of the campaign, 0 runs forever")
+    tps := flag.Float64("tps", 0, "The target rate to publish blocks at, 0 publishes as fast as possible")
+    burst := flag.Uint64("burst", 1, "The number of blocks that can be published at once to catch up with the target rate")
+    rpc := flag.String("rpc", "http://localhost:7076", "The nano-node RPC servers to publish to, separated by commas")
+    fanout := flag.String("fanout", "round_robin", "How blocks are published to the RPC servers: round_robin, pin or broadcast")
+    confirm := flag.Bool("confirm", false, "Measure how long it takes for published blocks to be confirmed")
+    confirmTimeout := flag.Duration("confirm_timeout", time.Minute, "The time after which a published block counts as unconfirmed")
+    confirmInterval := flag.Duration("confirm_interval", time.Second, "The time between polls for confirmations")
+    dryRunFlag := flag.Bool("dry_run", false, "Print the plan of the campaign using only read-only requests and exit")
+    powTime := flag.Duration("pow_time", DryRunPoWTime, "The time the dry run assumes for the work of a block")
+    measurePoW := flag.Bool("measure_pow", false, "Time work_generate on the node in the dry run instead of assuming -pow_time")
+    summaryFile := flag.String("summary", "", "Write the summary of the campaign as json to this file")
+    profile := flag.String("profile", "", "The load profile that drives the publish rate, e.g. ramp:from=10,to=100,length=10m")
+    state := flag.String("state", "", "Checkpoint the round state to this file after every round and resume from it")
+    coordinate := flag.Bool("coordinate", false, "Listen for peers and coordinate attacks with them")
+    listen := flag.String("listen", ":" + PeerPort, "The host:port to listen for peers on")
+    advertise := flag.String("advertise", "", "The host:port that peers reach this node at (default learns it from the peers)")
+    peerOnly := flag.Bool("peer_only", false, "Only serve and discover peers, without a wallet or a campaign")
+    peerFile := flag.String("peer_file", "peers.json", "Save the known peers to this file and reconnect to them at startup")
+    seedPeers := flag.String("peers", "", "The host:port of peers to bootstrap from, separated by commas (default port " + PeerPort + ")")
+    identity := flag.String("identity", "node.key", "The file with the ed25519 identity of this node, created if it does not exist")
+    allow := flag.String("allow", "", "The public keys of the peers to accept, in hex, separated by commas")
+    clusterSecret := flag.String("cluster_secret", "", "Accept every peer that knows this shared secret")
+    clockTolerance := flag.Duration("clock_tolerance", ClockTolerance, "Warn about peers whose clock is further off than this")
+    sharePoW := flag.Int("share_pow", 0, "Compute work for the frontiers of peers with this many requests to the node at once, 0 does not share")
     flag.Parse()
 
     Wallet = *wallet
     NAccounts = *nAccounts
+    Network = *network
+    Pipeline = *pipeline
+    Confirm = *confirm
+    ConfirmTimeout = *confirmTimeout
+    ConfirmInterval = *confirmInterval
+    setupEndpoints(strings.Split(*rpc, ","), *fanout)
+    Policy = WorkPolicy{ParseDifficulty(*sendDifficulty), ParseDifficulty(*receiveDifficulty), *activeDifficulty}
+    if (*tps > 0) {
+        Limiter = NewTokenBucket(*tps, *burst)
+    }
+    if (*profile != "") {
+        if (*tps > 0) {
+            fmt.Println("Error: A load profile sets the rate itself, -tps cannot be used with -profile.")
+            os.Exit(1)
+        }
+        Profile = ParseProfile(*profile)
+        Limiter = NewTokenBucket(Profile.Rate(0), *burst)
+        Target = ProfileBlocks(Profile)
+        fmt.Println("Load Profile:", Target, "blocks over", Profile.Length())
+    }
+    // Refuse to talk to peers before anything is done when no peer could be trusted.
+    if (*coordinate || *peerOnly) {
+        setupTrust(*allow, *clusterSecret)
+    }
+
+    // Peer-only mode serves the cluster without a wallet, as a seed for example.
+    if (*peerOnly) {
+        handleSignals()
+        if (*sharePoW > 0) {
+            shareWork(*sharePoW)
+        }
+        joinPeers(*listen, *advertise, *identity, *peerFile, *seedPeers)
+        fmt.Println("---Serving Peers Until Stopped---")
+        <-Campaign.Done()
+        savePeers(*peerFile)
+        printRoutes()
+        printWorkShares(workShares())
+        return
+    }
+
+    // Publish-only mode does not need a wallet, the blocks are already signed.
+    if (*publish != "") {
+        handleSignals()
+        Summary.Began = time.Now()
+        publishBundle(*publish)
+        Summary.Rounds++
+        finishCampaign(*summaryFile)
+        return
+    }
 
     fmt.Println("wallet:", Wallet)
     // fmt.Println("n_accounts:", NAccounts)
     // fmt.Println("n_trans:", NTransactions)
 
     // This is the starting Transactions Per Account.
-    // Useful for allocating space to the initial Blks slice.
+    // Every account is funded with at least this many raw.
     DefaultTPA  = uint64(1000) / NAccounts
 
     if (Wallet == "") {
@@ -93,84 +185,192 @@ func main() {
         os.Exit(1)
     }
 
-    // The total time to take to precompute a round of blocks in minutes.
-    tCompute = int64((time.Duration(5) * time.Minute) / time.Second)
+    // The total time to take to precompute a round of blocks.
+    if (*interval < time.Second) {
+        fmt.Println("Error: The interval must be at least one second.")
+        os.Exit(1)
+    }
+    tCompute = int64(*interval / time.Second)
 
 	fmt.Println("tCompute in seconds:", tCompute)
 
+    schedule := Schedule{Interval: *interval, Rounds: *rounds, Duration: *duration}
+    if (*start != "") {
+        var err error
+        schedule.Start, err = time.Parse(time.RFC3339, *start)
+        if err != nil {
+            fmt.Println("Error: Invalid start time:", err)
+            os.Exit(1)
+        }
+    }
+
+    if (*dryRunFlag) {
+        dryRun(schedule, *powTime, *measurePoW)
+        return
+    }
+
     setupAccounts()
 
+    Topo = NewTopology(*topology, NAccounts, *hub, *seed)
+    indexAddresses(Accounts[:NAccounts])
+
     max, nMax := findFunds()
 
     distributeFunds(max, nMax)
 
-    // The network and work channel will deal with communications between the
-    // network functions of the node with the computing side of the node.
-    naw := make(chan string)
+    // Continue with the round and phase of an earlier run.
+    first := int64(0)
+    if (*state != "") {
+        first = LoadCheckpoint(*state)
+    }
 
     // Serv will handle all incoming connections.
-    // go serv()
-
-    // peers["127.0.0.1"] = true
-    // go request("127.0.0.1", "get_peers")
+    if (*coordinate) {
+        ClockTolerance = *clockTolerance
+        if (*sharePoW > 0) {
+            shareWork(*sharePoW)
+        }
+        requestWork()
+        seeds := joinPeers(*listen, *advertise, *identity, *peerFile, *seedPeers)
+        syncClocks()
+        // Late joiners start on the schedule of the running cluster.
+        joinCluster(&schedule, append(seeds, peerList()...))
+    }
 
     // From this point, coordinate communications between the network and the precomputing work.
     // A good number to attempt to hit on the network is 7,000 Transactions Per Second.
-    // Attempt to adjust tCompute, network wide, to hit 7,000 TPS.
+    // Before every round the cluster agrees on tCompute and the next attack.
     // After every attack, broadcast the TPS to the network and gather TPS from other nodes.
-    // For now, sync this number and coordinate attack.
-    // For bootstrapping new nodes, they should attempt to connect to other nodes
-    // and ask for the current tCompute (perhaps taking an average).
-    for count := int64(0);;count++ {
-
-		var cTime time.Time = time.Now()
-        var timePastTest time.Duration = time.Duration(cTime.Unix() % tCompute) * time.Second
-		var nextTest time.Time = cTime.Add((time.Duration(tCompute) * time.Second) - timePastTest)
+    schedule.Began = time.Now()
+    Summary.Began = schedule.Began
+    handleSignals()
+    for count := first;;count++ {
+
+        // The schedule is on the cluster clock, which is the local clock
+        // unless coordinating.
+        if (*coordinate) {
+            syncClocks()
+        }
+		var nextTest time.Time = schedule.Next(clusterNow())
+        if (*coordinate) {
+            nextTest = agreeSchedule(&schedule, count, nextTest)
+            requestFrontiers()
+        }
+        if (schedule.Done(count - first, nextTest)) {
+            fmt.Println("---Campaign Finished---")
+            break
+        }
 
         fmt.Println("Next Attack Scheduled:", nextTest.Format(time.UnixDate))
+        attack := localTime(nextTest)
+
+        // Alternate between sending blocks and receiving blocks based on the count,
+        // or send and receive in every round when pipelined.
+        // The precomputation is halted when the attack is due or the campaign stops.
+        ctx, cancel := context.WithDeadline(Campaign, attack)
+        result := precomputeBlocks(ctx, count)
+        cancel()
+        if (result.Err == context.DeadlineExceeded) {
+            fmt.Println("---Scheduled Time Reached---")
+        }
+
+        LastPoWMax = result.Blocks
+        Summary.Precomputed += LastPoWMax
+        if (*export != "") {
+            // Compute here, publish there. Even a shutdown keeps what was precomputed.
+            // The next run continues with the next round, once the bundle
+            // is published the ledger matches the checkpoint.
+            ExportBundle(*export, Round)
+            if (*state != "") {
+                SaveCheckpoint(*state, count + 1, false)
+            }
+            break
+        }
+        // Finishing early does not move the attack.
+        select {
+        case <-time.After(time.Until(attack)):
+        case <-Campaign.Done():
+        }
+        if (stopping()) {
+            break
+        }
+        processBlocks(Campaign)
+        Summary.Rounds++
+        if (*coordinate) {
+            stats := RoundStats{count, LastPoWMax, Summary.RoundOutcomes[len(Summary.RoundOutcomes) - 1]}
+            broadcast(ActionReportRoundStats, Message{Stats: &stats})
+        }
+        if (*state != "") {
+            SaveCheckpoint(*state, count + 1, stopping())
+        }
+        if (stopping()) {
+            break
+        }
+    }
+    if (*coordinate) {
+        savePeers(*peerFile)
+    }
+    finishCampaign(*summaryFile)
+}
 
-        // Alternate between sending blocks and receiving blocks based on the count.
-        go precomputeBlocks(naw, nMax, count, LastPoWMax, nextTest)
-
-		select {
-		case message := <-naw:
-			if (message != "finished") {
-				// Some error
-				os.Exit(1)
-			}
-		case <-time.After(time.Until(nextTest)):
-			// Halt the PoW and begin processing transactions.
-			fmt.Println("\n---Scheduled Time Reached---")
-			naw <- "halt"
-			response := <-naw
-			if (response != "halted") {
-				// Some error
-				os.Exit(1)
-			}
-		}
-
-        LastPoWMax, _ = strconv.ParseUint(<-naw, 10, 64)
-        processBlocks(LastPoWMax, count)
+// joinPeers listens for peers and joins the DHT through the seeds and the
+// peers of an earlier run. It returns the seeds.
+// The trust must be set up.
+func joinPeers(listen, advertise, identity, peerFile, seedPeers string) ([]string) {
+    loadIdentity(identity)
+    setupTransport()
+    ln, err := listenPeers(listen)
+    if err == nil {
+        err = setupAddress(ln, advertise)
     }
+    if err != nil {
+        fmt.Println("Error: Unable to listen for peers:", err)
+        os.Exit(1)
+    }
+    Serving = true
+    go serv(ln)
+    var seeds []string
+    if (seedPeers != "") {
+        for _, seed := range strings.Split(seedPeers, ",") {
+            address, err := peerAddress(seed, PeerPort)
+            if err != nil {
+                fmt.Println("Error: Invalid peer:", err)
+                os.Exit(1)
+            }
+            seeds = append(seeds, address)
+        }
+    }
+    // Reconnect to the peers of an earlier run as well as the seeds.
+    loadPeers(peerFile)
+    bootstrapPeers(seeds)
+    go maintainPeers(peerFile)
+    return seeds
 }
 
 func setupAccounts() {
     // GET THE NUMBER OF ACCOUNTS FOR THE WALLET
-    nWalletAccounts := uint64(0)
     Accounts = AccountList()
-    for i := uint64(0); i < NAccounts; i++ {
-        if (len(Accounts[i]) > 0) {
-            nWalletAccounts++
-        }
-    }
+    nWalletAccounts := countAccounts(Accounts)
+    Accounts = Accounts[:nWalletAccounts]
     // GENERATE THE REMAINING ACCOUNTS
     if (nWalletAccounts < NAccounts) {
         for i := nWalletAccounts; i < NAccounts; i++ {
-            GenerateAccount()
+            Accounts = append(Accounts, GenerateAccount())
         }
     }
 }
 
+// countAccounts returns how many of the wallet accounts are used, at most NAccounts.
+func countAccounts(accounts []string) (uint64) {
+    nWalletAccounts := uint64(0)
+    for i := uint64(0); i < NAccounts && i < uint64(len(accounts)); i++ {
+        if (len(accounts[i]) > 0) {
+            nWalletAccounts++
+        }
+    }
+    return nWalletAccounts
+}
+
 func findFunds() (*big.Int, uint64) {
     // FIND FUNDS
     Total = big.NewInt(0)
@@ -210,13 +410,8 @@ func distributeFunds(max *big.Int, nMax uint64) {
     // GET ALL PREVIOUS BLOCKS FOR THE ACCOUNTS
     // RecentHashes needs initialization. This is required.
 
-    Hashes = make([][]string, NAccounts)
-    Blks = make([][]string, NAccounts)
-    for i := uint64(0); i < NAccounts; i++ {
-        Blks[i] = make([]string, DefaultTPA)
-        Hashes[i] = make([]string, DefaultTPA)
-        // RecentHashes[i] = GetPreviousBlock(Accounts[i])
-    }
+    Frontiers = make([]string, NAccounts)
+    Heights = make([]uint64, NAccounts)
 
     var ETA time.Duration
     var total time.Duration
@@ -235,10 +430,11 @@ func distributeFunds(max *big.Int, nMax uint64) {
                 // ADD MINIMUM BALANCE
                 // TODO: Watch for timeouts here...
                 deficit := Balances[k].Sub(amount, Balances[k])
-                Hashes[nMax][0] = Send(Accounts[nMax], account, deficit.String())
+                Frontiers[nMax] = Send(Accounts[nMax], account, deficit.String())
                 Balances[nMax].Sub(Balances[nMax], deficit)
+                Summary.Moved.Add(Summary.Moved, deficit)
                 // RECEIVE THE BLOCK
-                Hashes[k][0] = ReceiveBlock(account, Hashes[nMax][0])
+                Frontiers[k] = ReceiveBlock(account, Frontiers[nMax])
                 Balances[k].Set(amount)
                 stop := time.Now()
                 elapsed := stop.Sub(start)
@@ -252,135 +448,205 @@ func distributeFunds(max *big.Int, nMax uint64) {
     fmt.Println("---Finished Setting Up Accounts---")
 }
 
-func precomputeBlocks(naw chan string, nMax uint64, iteration int64, maximum uint64, nextTest time.Time) {
-    // ITERATE OVER EACH ACCOUNT
+// A send block that still has to be received by its destination.
+type Transfer struct {
+    To uint64
+    Hash string
+}
+
+// Pending holds the sends, in order, that have not been received yet.
+var Pending []Transfer
+
+// appendBlock adds the next block to the chain of the account.
+func appendBlock(k uint64, hash, blk, difficulty string) {
+    p := PackBlock(k, hash, blk, 0)
+    p.Difficulty = BlockDifficulty(&p, difficulty)
+    Round.Append(p)
+    Frontiers[k] = hash
+    Heights[k]++
+    // Ask the peers for the work of the next block.
+    wantWork(hash)
+}
+
+// ErrNoFunds stops a round when no account has funds left to send.
+var ErrNoFunds = errors.New("no account has funds left to send")
+
+// The result of a round of precomputation.
+type PrecomputeResult struct {
+    // The number of blocks created in the round.
+    Blocks uint64
+    // The number of blocks created for every account in the round.
+    Created []uint64
+    // The number of blocks of every account since the campaign began.
+    Heights []uint64
+    // Why the round stopped before it finished its work. Nil if it finished,
+    // context.DeadlineExceeded at the scheduled time, context.Canceled when
+    // the campaign is shutting down, or ErrNoFunds.
+    Err error
+}
+
+// precomputeBlocks creates blocks until the work of the round is done or
+// the context is done. The deadline of the context is the scheduled attack.
+func precomputeBlocks(ctx context.Context, iteration int64) (PrecomputeResult) {
+    // ITERATE OVER EACH TRANSFER
     // CREATE BLOCKS
     var ETA time.Duration
     var total time.Duration = 1
     var estimate uint64
-	if (iteration % 2 == 0) {
+    nextTest, _ := ctx.Deadline()
+    // Alternate between sending blocks and receiving blocks based on the iteration,
+    // unless the sends and receives are pipelined into every round.
+    sends := Pipeline || iteration % 2 == 0
+    receives := Pipeline || iteration % 2 == 1
+	if (Pipeline) {
+		fmt.Println("---Begin Precomputing PoW (Send and Receive Blocks)---")
+	} else if (sends) {
 		fmt.Println("---Begin Precomputing PoW (Send Blocks)---")
 	} else {
 		fmt.Println("---Begin Precomputing PoW (Receive Blocks)---")
 	}
-    amount := big.NewInt(1)
+    Round.Reset()
+    result := PrecomputeResult{Created: make([]uint64, NAccounts)}
+    amount := Amount
+    // Sends that were skipped in a row because the sender had no funds left.
+    var skipped uint64
+    var received uint64
+    // finish ends the round. The sends that were not received yet are
+    // received in a later round.
+    finish := func(err error) (PrecomputeResult) {
+        fmt.Println()
+        Pending = Pending[received:]
+        result.Blocks = Round.Len()
+        result.Heights = append([]uint64(nil), Heights...)
+        result.Err = err
+        return result
+    }
     // Continue to produce blocks until the scheduled attack time.
     // Estimate how many blocks that will be.
     for i := uint64(0);; i++ {
-        // Accounts[i % NAccounts] = the account to process at the moment.
-        k := i % NAccounts
-        // iter is the 'round' for each account.
-        iter := i / NAccounts
-
-		//fmt.Println(len(Blks[k]))
-        if i >= uint64(len(Blks[k]) - 1) * NAccounts {
-            fmt.Println("Reallocating slices from: ", len(Blks[k]), " to: ", (len(Blks[k]) + 1) * 2)
-            // Increase the length of Blks and Hashes.
-            for j := uint64(0); j < NAccounts; j++ {
-                // Create the new space.
-                b := make([]string, (len(Blks[j]) + 1) * 2)
-                h := make([]string, (len(Hashes[j]) + 1) * 2)
-                // Copy the data into the bigger slices.
-                copy(b, Blks[j])
-                copy(h, Hashes[j])
-                // Reassign the slices to the bigger slices.
-                Blks[j] = b
-                Hashes[j] = h
-            }
+        // No block is started once the attack is due.
+        if (ctx.Err() != nil) {
+            fmt.Println("\n---Halting Precomputation---")
+            return finish(ctx.Err())
         }
-
-        fmt.Print("\rBlock: ", i, "/", estimate, ", ", math.Floor((float64(i) / float64(estimate) * 1000)) / 10, "%")
+        n := Round.Len()
+        fmt.Print("\rBlock: ", n, "/", estimate, ", ", math.Floor((float64(n) / float64(estimate) * 1000)) / 10, "%")
         fmt.Print(" ETA: ", ETA.String(), " Finish: ", ((time.Now()).Add(ETA)).Format(time.UnixDate), "   \r")
         start := time.Now()
-        if iteration % 2 == 0 {
-			// Reserve Hashes[k][iter] for the receive blocks.
-            Hashes[k][iter + 1], Blks[k][iter + 1] = CreateSendBlock(Accounts[k], Accounts[(i + 1) % NAccounts], Balances[k].String(), amount.String(), Hashes[k][iter])
-            Balances[k].Sub(Balances[k], amount)
-        } else {
-            if uint64(i) > maximum {
-				fmt.Println()
-                fmt.Println("---Reached the maximum amount of blocks to receive---")
-				naw <- "finished"
-                naw <- strconv.FormatUint(i, 10)
-                return
+        if (sends) {
+            from, to := Topo.Transfer(i)
+            if (Balances[from].Cmp(amount) < 0) {
+                skipped++
+            } else {
+                skipped = 0
+                hash, blk, difficulty := CreateSendBlock(Accounts[from], Accounts[to], Balances[from].String(), amount.String(), Frontiers[from], takeWork(Frontiers[from], "send"))
+                appendBlock(from, hash, blk, difficulty)
+                result.Created[from]++
+                Pending = append(Pending, Transfer{to, hash})
+                Balances[from].Sub(Balances[from], amount)
             }
-            // The number should be so large that it will resolve to empty string.
-            // The transition between creating send blocks and creating receive blocks
-            // requires a lookup to know exactly what the most recent hash was for each account.
-            // This is because the interupted process before this will probably be incomplete.
-			/*
-            var recentHash uint64 = uint64(len(Hashes[k])) - 1
-            if iter > 0 {
-                recentHash = iter - 1
+        }
+        if (receives && received < uint64(len(Pending))) {
+            // The oldest send is received first. It is always published before
+            // its receive because the blocks are published in the order they are created.
+            t := Pending[received]
+            hash, blk, difficulty := CreateReceiveBlock(Accounts[t.To], t.Hash, Frontiers[t.To], takeWork(Frontiers[t.To], "receive"))
+            appendBlock(t.To, hash, blk, difficulty)
+            result.Created[t.To]++
+            Balances[t.To].Add(Balances[t.To], amount)
+            received++
+        }
+        if (!sends && received >= uint64(len(Pending))) {
+            fmt.Println("\n---Received every pending block---")
+            return finish(nil)
+        }
+        if (Target > 0 && Round.Len() >= Target) {
+            fmt.Println("\n---Precomputed the blocks of the load profile---")
+            return finish(nil)
+        }
+        if (Round.Len() == n) {
+            // Every pair of a mesh has been tried without finding funds.
+            if (skipped > NAccounts * NAccounts) {
+                fmt.Println("\n---No account has funds left to send---")
+                return finish(ErrNoFunds)
             }
-			if (k == 0) {
-				if (iter > 0) {
-						Hashes[k][recentHash], Blks[k][recentHash] = CreateReceiveBlock(Accounts[k], Hashes[NAccounts - 1][iter], Hashes[k][iter])
-						Balances[k].Add(Balances[k], amount)
-				} else {
-						// There is nothing to receive because no account has sent anything.
-				}
-			} else {
-			*/
-            Hashes[k][iter], Blks[k][iter] = CreateReceiveBlock(Accounts[k], Hashes[(i - 1) % NAccounts][iter + 1], Hashes[k][iter])
-            Balances[k].Add(Balances[k], amount)
-			//}
+            continue
         }
         stop := time.Now()
         elapsed := stop.Sub(start)
         total += elapsed
-        estimate = uint64(i) + uint64((time.Until(nextTest) / time.Duration(uint64(total) / uint64(i + 1))))
-        ETA = time.Duration((uint64(total) / uint64(i + 1)) * (estimate - uint64(i + 1)))
-
-        select {
-        case msg := <-naw:
-            if (msg == "halt") {
-                naw <- "halted"
-                fmt.Println("---Halting Precomputation---")
-                naw <- strconv.FormatUint(i, 10)
-                return
-            }
-        default:
-        }
+        n = Round.Len()
+        estimate = n + uint64((time.Until(nextTest) / time.Duration(uint64(total) / n)))
+        ETA = time.Duration((uint64(total) / n) * (estimate - n))
     }
-    fmt.Println()
-    fmt.Println("---Finished Precomputing Blocks---")
 }
 
-func processBlocks(max uint64, iteration int64) {
+func processBlocks(ctx context.Context) {
     // PROCESS BLOCKS
+    ReworkBlocks(ctx, Round)
+    publishBlocks(ctx, Round)
+}
+
+// publishBlocks sends every block to the node, in order.
+// The json of a block is only rendered right before it is sent.
+func publishBlocks(ctx context.Context, a *Arena) {
     var ETA time.Duration
     var total time.Duration = 1
+    max := a.Len()
+    meter := NewRateMeter()
+    begin := time.Now()
+    var outcomes OutcomeCounts
+    var tracker *ConfirmTracker
+    if (Confirm) {
+        tracker = StartConfirmations(len(Summary.RoundOutcomes))
+    }
+    for (uint64(len(Summary.AccountOutcomes)) < NAccounts) {
+        Summary.AccountOutcomes = append(Summary.AccountOutcomes, OutcomeCounts{})
+    }
     fmt.Println("---Begin Stress Test (Publishing Blocks)---")
     for i := uint64(0); i < max; i++ {
-	    // Accounts[i % NAccounts] = the account to process at the moment.
-        k := i % NAccounts
-        // iter is the 'round' for each account.
-        iter := i / NAccounts
-
+        if (ctx.Err() != nil) {
+            fmt.Println("\n---Stopped Publishing at Block", i, "of", max, "---")
+            break
+        }
         fmt.Print("\rBlock: ", i, "/", max, ", ", math.Floor((float64(i) / float64(max) * 1000)) / 10, "%")
         fmt.Print(" ETA: ", ETA.String(), " Finish: ", ((time.Now()).Add(ETA)).Format(time.UnixDate), "   \r")
+        if (Profile != nil && paceProfile(ctx, begin) != nil) {
+            fmt.Println("\n---Stopped Publishing at Block", i, "of", max, "---")
+            break
+        }
+        if (Limiter != nil && Limiter.Wait(ctx) != nil) {
+            fmt.Println("\n---Stopped Publishing at Block", i, "of", max, "---")
+            break
+        }
         start := time.Now()
-		if (iteration % 2 == 0) {
-			Hashes[k][iter] = ProcessBlock(Blks[k][iter + 1])
-		} else {
-			if (k == 0 && iter == 0) {
-				// Nothing to process.
-			} else {
-				var recentHash uint64 = uint64(len(Hashes[k])) - 1
-				if iter > 0 {
-					recentHash = iter - 1
-				}
-				Hashes[k][iter] = ProcessBlock(Blks[k][recentHash])
-			}
-		}
+        p := a.Get(i)
+        o := publishBlock(i, p)
+        outcomes[o]++
+        if (tracker != nil && o == Progress) {
+            tracker.Track(p.HashString())
+        }
+        Summary.AccountOutcomes[p.Account][o]++
+        Summary.Published++
+        if (p.Type == BlockSend && o == Progress) {
+            Summary.Moved.Add(Summary.Moved, Amount)
+        }
+        meter.Add()
         stop := time.Now()
         elapsed := stop.Sub(start)
         total += elapsed
         ETA = time.Duration((uint64(total) / (i + 1)) * (max - (i + 1)))
     }
+    meter.Stop()
     fmt.Println()
-	fmt.Println("\n---Finished Processing Blocks---")
+    fmt.Println("\n---Finished Processing Blocks---")
+    if (tracker != nil) {
+        tracker.Close()
+    }
+    fmt.Println("Round Outcomes:", outcomes)
+    Summary.Outcomes.Add(outcomes)
+    Summary.RoundOutcomes = append(Summary.RoundOutcomes, outcomes)
+    printEndpoints()
 }
 
 func receiveAllPending() {
@@ -423,145 +689,3 @@ func receivePendingBlock(account, source, previous string) (string) {
     hash := ReceiveBlock(account, source)
     return hash
 }
-
-// Version - The version number of the node.
-// Uid - A unique identifier used to identify nodes.
-// Action - The action of the request
-type Header struct {
-    Version uint
-    // Uid *big.Int
-    Action string
-}
-
-var pLock sync.Mutex
-
-var peers = make(map[string]bool)
-var myAddress string
-
-func serv() {
-    // The purpose of this function is to listen for new connections concurrently.
-    ln, err := net.Listen("tcp", ":9887")
-    if err != nil {
-	    // handle error
-        fmt.Println(err)
-    }
-    for {
-	    conn, err := ln.Accept()
-	    if err != nil {
-		    // handle error
-            fmt.Println(err)
-	    }
-	    go handleConnection(conn)
-    }
-}
-
-func request(address, action string) {
-    // The purpose of this function is to make requests to other nodes on the network.
-    if (address == myAddress) {
-        // Don't make requests to ourselves.
-        return
-    }
-    address += ":9887"
-
-    var request Header
-    request.Version = 3
-    request.Action = action
-
-    fmt.Println("Connecting to:", address)
-    conn, err := net.Dial("tcp", address)
-    if err != nil {
-	    // handle error
-        fmt.Println(err)
-    }
-    if (myAddress == "") {
-        myAddress = strings.Split(conn.LocalAddr().String(), ":")[0]
-        fmt.Println("My Address:", myAddress)
-    }
-
-    enc := gob.NewEncoder(conn)
-    err = enc.Encode(request)
-    if err != nil {
-        log.Fatal("encode error:", err)
-    }
-    switch action {
-    case "get_peers":
-        dec := gob.NewDecoder(conn)
-        fmt.Println("Receiving Peers from:", conn.RemoteAddr())
-        receivePeers(dec)
-    case "relay_pow":
-    }
-}
-
-func handleConnection(conn net.Conn) {
-    // This function handles requests.
-    // It will read the message header, determine the action to take,
-    // and then return that information back to the peer.
-
-    fmt.Printf("...Connection Established to %s...\n", conn.RemoteAddr())
-    // Add the peer to the list of known Peers.
-    pLock.Lock()
-    peers[strings.Split(conn.RemoteAddr().String(), ":")[0]] = true
-    pLock.Unlock()
-
-    dec := gob.NewDecoder(conn)
-    // Decode (receive) the value.
-    var h Header
-    err := dec.Decode(&h)
-    if err != nil {
-        log.Fatal("decode error:", err)
-    }
-
-    fmt.Println(h.Action)
-    enc := gob.NewEncoder(conn)
-    if (h.Action == "get_peers") {
-        relayPeers(enc)
-        fmt.Println("Relayed Peers")
-    }
-    fmt.Println("...Terminating Connection...")
-    err = conn.Close()
-    if err != nil {
-	    // handle error
-        fmt.Println(err)
-	}
-}
-
-/*
-func relayPoW() {
-    // Send the number of precached PoW's.
-    for k, v := range peers {
-        // If haven't received the most recent PoWs from peer
-        if (!PoWs[k]) {
-            go request(k, "relay_pow")
-        }
-    }
-}
-*/
-
-func relayPeers(enc *gob.Encoder) {
-    pLock.Lock()
-    err := enc.Encode(peers)
-    pLock.Unlock()
-
-    if err != nil {
-        log.Fatal("encode error:", err)
-    }
-}
-
-func receivePeers(dec *gob.Decoder) {
-    var pMap map[string]bool
-    err := dec.Decode(&pMap)
-    if err != nil {
-        log.Fatal("decode error:", err)
-    }
-
-    pLock.Lock()
-    for k := range pMap {
-        _, ok := peers[k]
-        if !ok {
-            // Create new connections here.
-            peers[k] = true
-            go request(k, "get_peers")
-        }
-    }
-    pLock.Unlock()
-}
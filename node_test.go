@@ -0,0 +1,194 @@
+/*
+ * Copyright (C) 2018 Keaton Bruce
+ *
+ * This file is part of nano-prepowtx.
+ *
+ * nano-prepowtx is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * nano-prepowtx is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with nano-prepowtx. If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+    "fmt"
+    "time"
+    "context"
+    "math/big"
+    "testing"
+    "sync/atomic"
+    "net/http"
+    "net/http/httptest"
+    "encoding/json"
+)
+
+// fakeNode answers block_create like a node, taking delay for every block.
+// It returns the number of blocks it created so far.
+func fakeNode(t *testing.T, delay time.Duration) (*uint64) {
+    var created uint64
+    srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        var req map[string]string
+        json.NewDecoder(r.Body).Decode(&req)
+        if (req["action"] != "block_create") {
+            w.Write([]byte(`{"error":"unexpected action"}`))
+            return
+        }
+        time.Sleep(delay)
+        n := atomic.AddUint64(&created, 1)
+        hash := fmt.Sprintf("%064X", n)
+        var blk interface{}
+        if (req["type"] == "send") {
+            balance, _ := new(big.Int).SetString(req["balance"], 10)
+            amount, _ := new(big.Int).SetString(req["amount"], 10)
+            balance.Sub(balance, amount)
+            blk = Block{"send", req["previous"], req["destination"], fmt.Sprintf("%032X", balance), "0000000000000001", fmt.Sprintf("%0128X", n)}
+        } else {
+            blk = RBlock{"receive", req["previous"], req["source"], "0000000000000001", fmt.Sprintf("%0128X", n)}
+        }
+        b, _ := json.Marshal(blk)
+        json.NewEncoder(w).Encode(BCResponse{hash, string(b), "ffffffc000000000"})
+    }))
+    t.Cleanup(srv.Close)
+    Nodes = []string{srv.URL}
+    return &created
+}
+
+// setupRound sets up a campaign of n funded accounts in a ring that sends in
+// this round.
+func setupRound(n uint64) {
+    NAccounts = n
+    Accounts = nil
+    Balances = nil
+    Frontiers = nil
+    for k := uint64(0); k < n; k++ {
+        var key [32]byte
+        key[0] = byte(k + 1)
+        Accounts = append(Accounts, encodeAddress(key))
+        Balances = append(Balances, big.NewInt(1000))
+        Frontiers = append(Frontiers, fmt.Sprintf("%064X", 1 << 20 + k))
+    }
+    indexAddresses(Accounts)
+    Heights = make([]uint64, n)
+    Pending = nil
+    Pipeline = false
+    Target = 0
+    Topo = NewTopology("ring", n, 0, 1)
+}
+
+func sum(counts []uint64) (uint64) {
+    var total uint64
+    for _, c := range counts {
+        total += c
+    }
+    return total
+}
+
+func TestPrecomputeCancelled(t *testing.T) {
+    created := fakeNode(t, 0)
+    setupRound(4)
+    frontiers := append([]string(nil), Frontiers...)
+    ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(time.Hour))
+    cancel()
+
+    result := precomputeBlocks(ctx, 0)
+    if (result.Err != context.Canceled) {
+        t.Fatalf("Err = %v, want %v", result.Err, context.Canceled)
+    }
+    if (result.Blocks != 0 || sum(result.Created) != 0 || Round.Len() != 0 || *created != 0) {
+        t.Fatalf("a cancelled round created blocks: %+v, node %d", result, *created)
+    }
+    if (len(result.Heights) != 4 || sum(result.Heights) != 0 || len(Pending) != 0) {
+        t.Fatalf("Heights = %v, Pending = %v", result.Heights, Pending)
+    }
+    for k, f := range Frontiers {
+        if (f != frontiers[k]) {
+            t.Fatalf("frontier %d moved without a block", k)
+        }
+    }
+}
+
+func TestPrecomputeExpired(t *testing.T) {
+    created := fakeNode(t, 0)
+    setupRound(4)
+    ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+    defer cancel()
+
+    result := precomputeBlocks(ctx, 0)
+    if (result.Err != context.DeadlineExceeded) {
+        t.Fatalf("Err = %v, want %v", result.Err, context.DeadlineExceeded)
+    }
+    if (result.Blocks != 0 || sum(result.Created) != 0 || *created != 0) {
+        t.Fatalf("an expired round created blocks: %+v, node %d", result, *created)
+    }
+}
+
+// A deadline in the middle of the round keeps what was created up to it.
+func TestPrecomputeDeadline(t *testing.T) {
+    created := fakeNode(t, 5 * time.Millisecond)
+    setupRound(3)
+    ctx, cancel := context.WithTimeout(context.Background(), 100 * time.Millisecond)
+    defer cancel()
+
+    result := precomputeBlocks(ctx, 0)
+    if (result.Err != context.DeadlineExceeded) {
+        t.Fatalf("Err = %v, want %v", result.Err, context.DeadlineExceeded)
+    }
+    if (result.Blocks == 0 || result.Blocks != Round.Len() || result.Blocks != *created) {
+        t.Fatalf("Blocks = %d, arena %d, node %d", result.Blocks, Round.Len(), *created)
+    }
+    if (sum(result.Created) != result.Blocks || sum(result.Heights) != result.Blocks || uint64(len(Pending)) != result.Blocks) {
+        t.Fatalf("Created %v, Heights %v, Pending %d for %d blocks", result.Created, result.Heights, len(Pending), result.Blocks)
+    }
+    // The ring sends from every account in turn.
+    for k, c := range result.Created {
+        if (c + 1 < result.Blocks / 3 || c > result.Blocks / 3 + 1) {
+            t.Fatalf("account %d created %d of %d blocks", k, c, result.Blocks)
+        }
+    }
+}
+
+// A send round followed by a receive round receives every send.
+func TestPrecomputeTargetAndReceive(t *testing.T) {
+    fakeNode(t, 0)
+    setupRound(3)
+    Target = 7
+    ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+    defer cancel()
+
+    sends := precomputeBlocks(ctx, 0)
+    if (sends.Err != nil || sends.Blocks != 7 || len(Pending) != 7) {
+        t.Fatalf("send round: %+v, pending %d", sends, len(Pending))
+    }
+    if (Balances[0].Int64() != 997 || Balances[1].Int64() != 998) {
+        t.Fatalf("balances %v %v after the sends", Balances[0], Balances[1])
+    }
+    for k := 0; k < 3; k++ {
+        if (Round.Get(uint64(k)).Type != BlockSend || Frontiers[Round.Get(uint64(k)).Account] == "") {
+            t.Fatalf("block %d is not a send", k)
+        }
+    }
+
+    Target = 0
+    receives := precomputeBlocks(ctx, 1)
+    if (receives.Err != nil || receives.Blocks != 7 || len(Pending) != 0) {
+        t.Fatalf("receive round: %+v, pending %d", receives, len(Pending))
+    }
+    if (Round.Get(0).Type != BlockReceive || Round.Get(0).Account != 1) {
+        t.Fatalf("the first receive is %+v", *Round.Get(0))
+    }
+    for k, h := range receives.Heights {
+        if (h != sends.Created[k] + receives.Created[k]) {
+            t.Fatalf("account %d has height %d", k, h)
+        }
+    }
+}
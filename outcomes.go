@@ -0,0 +1,139 @@
+/*
+ * Copyright (C) 2018 Keaton Bruce
+ *
+ * This file is part of nano-prepowtx.
+ *
+ * nano-prepowtx is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * nano-prepowtx is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with nano-prepowtx. If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+    "fmt"
+    "strings"
+    "encoding/json"
+)
+
+/*
+ * Every publish has an outcome. The node reports anything but progress as an
+ * error string, which is classified here, so a slow node (transport errors)
+ * can be told apart from a broken chain (gaps, forks and bad blocks).
+ */
+
+type Outcome int
+
+const (
+    Progress Outcome = iota
+    Old
+    Fork
+    GapPrevious
+    GapSource
+    BadSignature
+    InsufficientWork
+    BalanceMismatch
+    Unreceivable
+    TransportError
+    OtherError
+    NOutcomes
+)
+
+var OutcomeNames = [NOutcomes]string{
+    "progress",
+    "old",
+    "fork",
+    "gap_previous",
+    "gap_source",
+    "bad_signature",
+    "insufficient_work",
+    "balance_mismatch",
+    "unreceivable",
+    "transport_error",
+    "other_error",
+}
+
+func (o Outcome) String() (string) {
+    return OutcomeNames[o]
+}
+
+// Classify returns the outcome of a process request from the error of the
+// node, or from the error of the request itself.
+func Classify(rejected string, err error) (Outcome) {
+    if err != nil {
+        return TransportError
+    }
+    r := strings.ToLower(rejected)
+    switch {
+    case r == "":
+        return Progress
+    case strings.HasPrefix(r, "old"):
+        return Old
+    case strings.Contains(r, "fork"):
+        return Fork
+    case strings.Contains(r, "gap previous"):
+        return GapPrevious
+    case strings.Contains(r, "gap source"):
+        return GapSource
+    case strings.Contains(r, "signature"):
+        return BadSignature
+    case strings.Contains(r, "work"):
+        return InsufficientWork
+    case strings.Contains(r, "balance"):
+        return BalanceMismatch
+    case strings.Contains(r, "unreceivable"):
+        return Unreceivable
+    }
+    return OtherError
+}
+
+// The number of publishes for every outcome.
+type OutcomeCounts [NOutcomes]uint64
+
+func (c *OutcomeCounts) Add(o OutcomeCounts) {
+    for i := range c {
+        c[i] += o[i]
+    }
+}
+
+func (c OutcomeCounts) Total() (uint64) {
+    var total uint64
+    for _, n := range c {
+        total += n
+    }
+    return total
+}
+
+// The outcomes are written by name, and only the ones that happened.
+func (c OutcomeCounts) MarshalJSON() ([]byte, error) {
+    m := make(map[string]uint64)
+    for i, n := range c {
+        if (n > 0) {
+            m[OutcomeNames[i]] = n
+        }
+    }
+    return json.Marshal(m)
+}
+
+func (c OutcomeCounts) String() (string) {
+    var parts []string
+    for i, n := range c {
+        if (n > 0) {
+            parts = append(parts, fmt.Sprint(OutcomeNames[i], ": ", n))
+        }
+    }
+    if (len(parts) == 0) {
+        return "none"
+    }
+    return strings.Join(parts, ", ")
+}
@@ -0,0 +1,56 @@
+/*
+ * Copyright (C) 2018 Keaton Bruce
+ *
+ * This file is part of nano-prepowtx.
+ *
+ * nano-prepowtx is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * nano-prepowtx is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with nano-prepowtx. If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+    "errors"
+    "testing"
+)
+
+// The errors are the ones the node answers process with.
+func TestClassify(t *testing.T) {
+    for _, tc := range []struct {
+        rejected string
+        want Outcome
+    }{
+        {"", Progress},
+        {"Old block", Old},
+        {"Fork", Fork},
+        {"Gap previous block", GapPrevious},
+        {"Gap source block", GapSource},
+        {"Bad signature", BadSignature},
+        {"Block work is less than threshold", InsufficientWork},
+        {"Block work is insufficient", InsufficientWork},
+        {"Balance mismatch", BalanceMismatch},
+        {"Unreceivable", Unreceivable},
+        {"Negative spend", OtherError},
+        {"Representative mismatch", OtherError},
+        {"Block is invalid", OtherError},
+        {"Gap epoch open pending", OtherError},
+    } {
+        if o := Classify(tc.rejected, nil); (o != tc.want) {
+            t.Errorf("Classify(%q) = %v, want %v", tc.rejected, o, tc.want)
+        }
+    }
+    if o := Classify("", errors.New("connection refused")); (o != TransportError) {
+        t.Errorf("a failed request is %v, want %v", o, TransportError)
+    }
+}
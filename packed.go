@@ -0,0 +1,233 @@
+/*
+ * Copyright (C) 2018 Keaton Bruce
+ *
+ * This file is part of nano-prepowtx.
+ *
+ * nano-prepowtx is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * nano-prepowtx is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with nano-prepowtx. If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+    "fmt"
+    "os"
+    "strings"
+    "strconv"
+    "encoding/hex"
+    "encoding/json"
+)
+
+/*
+ * Blocks are kept in a compact binary form instead of the json strings that
+ * the node returns. Every field has a fixed size, and the blocks of a round
+ * are stored in an Arena of fixed-size chunks. Growing the arena only adds a
+ * chunk, nothing that is already stored is copied.
+ *
+ * The json for a block is only rendered when it is published or exported.
+ */
+
+const (
+    BlockSend byte = iota + 1
+    BlockReceive
+)
+
+type PackedBlock struct {
+    Type byte
+    // The index of the account in Accounts.
+    Account uint32
+    Hash [32]byte
+    Previous [32]byte
+    // The public key of the destination for a send, the source hash for a receive.
+    Link [32]byte
+    // Only used by send blocks.
+    Balance [16]byte
+    Work uint64
+    Signature [64]byte
+    // The difficulty of the work when the block was created, zero if unknown.
+    Difficulty uint64
+}
+
+// The number of blocks in every chunk of an arena.
+const ChunkSize = 4096
+
+type Arena struct {
+    chunks [][]PackedBlock
+    n uint64
+}
+
+// The blocks of the current round, in the order they were created.
+// This is also the order they have to be published in.
+var Round = &Arena{}
+
+func (a *Arena) Len() (uint64) {
+    return a.n
+}
+
+// Get returns the i-th block. The pointer stays valid while the arena grows.
+func (a *Arena) Get(i uint64) (*PackedBlock) {
+    return &a.chunks[i / ChunkSize][i % ChunkSize]
+}
+
+func (a *Arena) Append(b PackedBlock) {
+    if (a.n / ChunkSize >= uint64(len(a.chunks))) {
+        a.chunks = append(a.chunks, make([]PackedBlock, ChunkSize))
+    }
+    *a.Get(a.n) = b
+    a.n++
+}
+
+// Reset empties the arena but keeps its chunks for the next round.
+func (a *Arena) Reset() {
+    a.n = 0
+}
+
+// The nano base32 alphabet of account addresses.
+const addressAlphabet = "13456789abcdefghijkmnopqrstuwxyz"
+
+// AddressKey decodes the public key of an account address.
+// The checksum at the end of the address is not verified.
+func AddressKey(address string) ([32]byte, bool) {
+    var key [32]byte
+    i := strings.LastIndex(address, "_")
+    if (i < 0 || len(address) - i - 1 != 60) {
+        return key, false
+    }
+    // 52 characters hold 260 bits, the top 4 of which are padding.
+    var acc uint
+    var bits uint
+    n := 0
+    for j, c := range address[i + 1:i + 53] {
+        v := strings.IndexRune(addressAlphabet, c)
+        if (v < 0) {
+            return key, false
+        }
+        acc = acc << 5 | uint(v)
+        bits += 5
+        if (j == 0) {
+            // Drop the padding.
+            acc &= 1
+            bits = 1
+        }
+        if (bits >= 8) {
+            bits -= 8
+            key[n] = byte(acc >> bits)
+            n++
+            acc &= 1 << bits - 1
+        }
+    }
+    return key, true
+}
+
+// Addresses maps public keys back to the addresses of the campaign accounts.
+var Addresses map[[32]byte]string
+
+func indexAddresses(accounts []string) {
+    Addresses = make(map[[32]byte]string, len(accounts))
+    for _, account := range accounts {
+        key, ok := AddressKey(account)
+        if (!ok) {
+            fmt.Println("Error: Invalid account address:", account)
+            os.Exit(1)
+        }
+        Addresses[key] = account
+    }
+}
+
+func decodeHex(dst []byte, s string) (bool) {
+    if (hex.DecodedLen(len(s)) != len(dst)) {
+        return false
+    }
+    _, err := hex.Decode(dst, []byte(s))
+    return err == nil
+}
+
+func encodeHex(src []byte) (string) {
+    return strings.ToUpper(hex.EncodeToString(src))
+}
+
+// PackBlock converts the json of a block, as created by the node, to its binary form.
+func PackBlock(k uint64, hash string, blk string, difficulty uint64) (PackedBlock) {
+    var p PackedBlock
+    var b map[string]string
+    err := json.Unmarshal([]byte(blk), &b)
+    if err != nil {
+        fmt.Println("Error: Unable to read block", hash, err)
+        os.Exit(1)
+    }
+
+    p.Account = uint32(k)
+    p.Difficulty = difficulty
+    ok := decodeHex(p.Hash[:], hash) && decodeHex(p.Previous[:], b["previous"]) && decodeHex(p.Signature[:], b["signature"])
+    work, err := strconv.ParseUint(b["work"], 16, 64)
+    ok = ok && err == nil
+    p.Work = work
+    switch b["type"] {
+    case "send":
+        p.Type = BlockSend
+        var known bool
+        p.Link, known = AddressKey(b["destination"])
+        ok = ok && known && decodeHex(p.Balance[:], b["balance"])
+        if (ok && Addresses[p.Link] == "") {
+            fmt.Println("Error: Only sends to campaign accounts can be stored:", b["destination"])
+            os.Exit(1)
+        }
+    case "receive":
+        p.Type = BlockReceive
+        ok = ok && decodeHex(p.Link[:], b["source"])
+    default:
+        fmt.Println("Error: Unsupported block type:", b["type"])
+        os.Exit(1)
+    }
+    if (!ok) {
+        fmt.Println("Error: Malformed block", hash)
+        os.Exit(1)
+    }
+    return p
+}
+
+func (p *PackedBlock) Subtype() (string) {
+    if (p.Type == BlockSend) {
+        return "send"
+    }
+    return "receive"
+}
+
+func (p *PackedBlock) HashString() (string) {
+    return encodeHex(p.Hash[:])
+}
+
+func (p *PackedBlock) PreviousString() (string) {
+    return encodeHex(p.Previous[:])
+}
+
+func (p *PackedBlock) WorkString() (string) {
+    return fmt.Sprintf("%016x", p.Work)
+}
+
+// JSON renders the block the way the node expects it in a process request.
+func (p *PackedBlock) JSON() (string) {
+    var v interface{}
+    if (p.Type == BlockSend) {
+        v = Block{"send", p.PreviousString(), Addresses[p.Link], encodeHex(p.Balance[:]), p.WorkString(), encodeHex(p.Signature[:])}
+    } else {
+        v = RBlock{"receive", p.PreviousString(), encodeHex(p.Link[:]), p.WorkString(), encodeHex(p.Signature[:])}
+    }
+    b, err := json.Marshal(v)
+    if err != nil {
+        fmt.Println(err)
+        os.Exit(1)
+    }
+    return string(b)
+}
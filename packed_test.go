@@ -0,0 +1,215 @@
+/*
+ * Copyright (C) 2018 Keaton Bruce
+ *
+ * This file is part of nano-prepowtx.
+ *
+ * nano-prepowtx is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * nano-prepowtx is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with nano-prepowtx. If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+    "strings"
+    "testing"
+    "math/rand"
+    "encoding/json"
+)
+
+// The genesis account of the live network and the burn account.
+const genesisAccount = "xrb_3t6k35gi95xu6tergt6p69ck76ogmitsa8mnijtpxm9fkcm736xtoncuohr3"
+const genesisKey = "E89208DD038FBB269987689621D52292AE9C35941A7484756ECCED92A65093BA"
+const burnAccount = "xrb_1111111111111111111111111111111111111111111111111111hifc8npp"
+
+// encodeAddress is the inverse of AddressKey. The checksum is left as ones,
+// since AddressKey does not verify it.
+func encodeAddress(key [32]byte) (string) {
+    // 4 bits of padding and the 256 bits of the key, 5 bits per character.
+    var acc uint
+    bits := uint(4)
+    out := make([]byte, 0, 52)
+    for _, b := range key {
+        acc = acc << 8 | uint(b)
+        bits += 8
+        for bits >= 5 {
+            bits -= 5
+            out = append(out, addressAlphabet[(acc >> bits) & 31])
+        }
+        acc &= 1 << bits - 1
+    }
+    return "nano_" + string(out) + strings.Repeat("1", 8)
+}
+
+func TestAddressKey(t *testing.T) {
+    key, ok := AddressKey(genesisAccount)
+    if (!ok || encodeHex(key[:]) != genesisKey) {
+        t.Fatalf("AddressKey(genesis) = %X, %v, want %s", key, ok, genesisKey)
+    }
+    key, ok = AddressKey(burnAccount)
+    if (!ok || key != [32]byte{}) {
+        t.Fatalf("AddressKey(burn) = %X, %v, want zeros", key, ok)
+    }
+    for _, bad := range []string{"", "xrb_", "xrb_3t6k35gi95xu6", genesisAccount[:len(genesisAccount) - 1], strings.Replace(genesisAccount, "3t6k", "3t0k", 1)} {
+        if _, ok := AddressKey(bad); ok {
+            t.Errorf("AddressKey(%q) accepted an invalid address", bad)
+        }
+    }
+
+    r := rand.New(rand.NewSource(1))
+    for i := 0; i < 1000; i++ {
+        var want [32]byte
+        r.Read(want[:])
+        address := encodeAddress(want)
+        got, ok := AddressKey(address)
+        if (!ok || got != want) {
+            t.Fatalf("AddressKey(%s) = %X, %v, want %X", address, got, ok, want)
+        }
+    }
+    if (encodeAddress(mustKey(t, genesisAccount))[5:57] != genesisAccount[4:56]) {
+        t.Fatalf("encodeAddress does not match the genesis account")
+    }
+}
+
+func mustKey(t testing.TB, address string) ([32]byte) {
+    key, ok := AddressKey(address)
+    if (!ok) {
+        t.Fatalf("invalid address %s", address)
+    }
+    return key
+}
+
+func testBlocks() (string, string, string, string) {
+    indexAddresses([]string{genesisAccount, burnAccount})
+    send := Block{"send", strings.Repeat("B1", 32), burnAccount, strings.Repeat("0C", 16), "0123456789abcdef", strings.Repeat("D4", 64)}
+    s, _ := json.Marshal(send)
+    receive := RBlock{"receive", strings.Repeat("E5", 32), strings.Repeat("F6", 32), "fedcba9876543210", strings.Repeat("A7", 64)}
+    r, _ := json.Marshal(receive)
+    return strings.Repeat("A1", 32), string(s), strings.Repeat("C3", 32), string(r)
+}
+
+// The json of a packed block must be the block that the node created, or the
+// node rejects it when it is published.
+func TestPackBlockJSON(t *testing.T) {
+    sendHash, send, receiveHash, receive := testBlocks()
+
+    p := PackBlock(1, sendHash, send, 42)
+    if (p.Type != BlockSend || p.Account != 1 || p.Difficulty != 42 || p.Subtype() != "send") {
+        t.Fatalf("PackBlock(send) = %+v", p)
+    }
+    if (p.HashString() != sendHash || p.Link != mustKey(t, burnAccount)) {
+        t.Fatalf("PackBlock(send) hash %s link %X", p.HashString(), p.Link)
+    }
+    if (p.JSON() != send) {
+        t.Fatalf("send round trip:\n got %s\nwant %s", p.JSON(), send)
+    }
+
+    p = PackBlock(0, receiveHash, receive, 0)
+    if (p.Type != BlockReceive || p.Subtype() != "receive" || p.HashString() != receiveHash) {
+        t.Fatalf("PackBlock(receive) = %+v", p)
+    }
+    if (p.JSON() != receive) {
+        t.Fatalf("receive round trip:\n got %s\nwant %s", p.JSON(), receive)
+    }
+}
+
+// The node may return the hex of a block in lower case. It is rendered in
+// upper case, which the node reads the same.
+func TestPackBlockCase(t *testing.T) {
+    sendHash, send, _, _ := testBlocks()
+    p := PackBlock(1, strings.ToLower(sendHash), strings.ToLower(send), 0)
+    var got, want map[string]string
+    json.Unmarshal([]byte(p.JSON()), &got)
+    json.Unmarshal([]byte(send), &want)
+    for field, v := range want {
+        if (!strings.EqualFold(got[field], v)) {
+            t.Errorf("%s = %s, want %s", field, got[field], v)
+        }
+    }
+    if (got["work"] != want["work"]) {
+        t.Errorf("work = %s, want %s", got["work"], want["work"])
+    }
+}
+
+func TestArena(t *testing.T) {
+    sendHash, send, _, _ := testBlocks()
+    p := PackBlock(1, sendHash, send, 0)
+    a := &Arena{}
+    n := uint64(2 * ChunkSize + 7)
+    for i := uint64(0); i < n; i++ {
+        p.Work = i
+        a.Append(p)
+    }
+    held := a.Get(3)
+    a.Append(p)
+    if (a.Len() != n + 1 || held != a.Get(3) || held.Work != 3) {
+        t.Fatalf("the arena moved or lost a block: len %d work %d", a.Len(), held.Work)
+    }
+    for i := uint64(0); i < n; i++ {
+        if (a.Get(i).Work != i) {
+            t.Fatalf("block %d has work %d", i, a.Get(i).Work)
+        }
+    }
+    a.Reset()
+    if (a.Len() != 0 || len(a.chunks) != 3) {
+        t.Fatalf("Reset: len %d chunks %d", a.Len(), len(a.chunks))
+    }
+}
+
+// The memory of a round kept as the json strings from the node, against a
+// round in an arena. Compare the B/op of both.
+func BenchmarkJSONBlocks(b *testing.B) {
+    sendHash, send, _, _ := testBlocks()
+    b.ReportAllocs()
+    b.ResetTimer()
+    var blocks, hashes []string
+    for i := 0; i < b.N; i++ {
+        // Every block has its own strings, like the node responses.
+        blocks = append(blocks, string([]byte(send)))
+        hashes = append(hashes, string([]byte(sendHash)))
+    }
+    if (len(blocks) != len(hashes)) {
+        b.Fatal("lost blocks")
+    }
+}
+
+func BenchmarkPackedBlocks(b *testing.B) {
+    sendHash, send, _, _ := testBlocks()
+    p := PackBlock(1, sendHash, send, 0)
+    b.ReportAllocs()
+    b.ResetTimer()
+    a := &Arena{}
+    for i := 0; i < b.N; i++ {
+        a.Append(p)
+    }
+    if (a.Len() != uint64(b.N)) {
+        b.Fatal("lost blocks")
+    }
+}
+
+func BenchmarkPackBlock(b *testing.B) {
+    sendHash, send, _, _ := testBlocks()
+    b.ReportAllocs()
+    for i := 0; i < b.N; i++ {
+        PackBlock(1, sendHash, send, 0)
+    }
+}
+
+func BenchmarkBlockJSON(b *testing.B) {
+    sendHash, send, _, _ := testBlocks()
+    p := PackBlock(1, sendHash, send, 0)
+    b.ReportAllocs()
+    for i := 0; i < b.N; i++ {
+        p.JSON()
+    }
+}
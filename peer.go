@@ -0,0 +1,445 @@
+/*
+ * Copyright (C) 2018 Keaton Bruce
+ *
+ * This file is part of nano-prepowtx.
+ *
+ * nano-prepowtx is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * nano-prepowtx is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with nano-prepowtx. If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+    "fmt"
+    "errors"
+    "net"
+    "sort"
+    "crypto/tls"
+    "encoding/gob"
+    "sync"
+    "time"
+)
+
+/*
+ * Peers coordinate over TLS with gob encoded Messages (see transport.go),
+ * every one signed in a Frame by the identity of its sender (see
+ * identity.go). A connection starts with hello, in which both sides say which
+ * protocol versions they speak and which actions they handle. The highest
+ * version both speak is used for the rest of the connection; without one the
+ * connection is refused.
+ *
+ * After hello a connection carries any number of requests. Every request has
+ * an ID and every answer carries that ID in Reply, so answers can be matched
+ * to their requests. An action that is not known is answered with an error
+ * and the connection stays open.
+ *
+ * Actions:
+ *     hello              - Negotiate the version and the capabilities.
+ *     get_peers          - Answered with the addresses of every live peer.
+ *     find_node          - Answered with the contacts closest to an ID (see dht.go).
+ *     announce_schedule  - The next attack and the interval of a peer.
+ *     get_schedule       - Answered with the schedule this node attacks on.
+ *     report_round_stats - What a peer precomputed and published in a round.
+ *     time_sync          - Answered with the times it was received and answered.
+ *     request_pow        - Frontiers to compute work for (see work.go).
+ *     relay_pow          - Work for frontiers, computed by a peer.
+ */
+
+// The protocol versions this node speaks. Version 3 was a bare Header that
+// only knew get_peers, version 4 sent Messages without signing them.
+const MinProtocolVersion = 5
+const ProtocolVersion = 5
+
+const PeerPort = "9887"
+
+// The time to connect to a peer.
+const PeerDialTimeout = 10 * time.Second
+
+const (
+    ActionHello = "hello"
+    ActionGetPeers = "get_peers"
+    ActionAnnounceSchedule = "announce_schedule"
+    ActionReportRoundStats = "report_round_stats"
+    ActionRelayPoW = "relay_pow"
+    // Answers without a body of their own.
+    ActionAck = "ack"
+    ActionError = "error"
+)
+
+const (
+    ErrCodeVersion = "unsupported_version"
+    ErrCodeHelloRequired = "hello_required"
+    ErrCodeUnknownAction = "unknown_action"
+    ErrCodeBadRequest = "bad_request"
+    ErrCodeUnavailable = "unavailable"
+)
+
+// Version - The version of the protocol, the negotiated one after hello.
+// ID - Identifies a request on its connection.
+// Reply - The ID of the request that is answered, 0 for requests.
+// Action - The action of the request
+type Header struct {
+    Version uint
+    // Uid *big.Int
+    ID uint64
+    Reply uint64
+    Action string
+}
+
+// Message is a Header and the body of its action. Only the body that belongs
+// to the action is set.
+type Message struct {
+    Header Header
+    Hello *Hello
+    Peers []string
+    Schedule *Announcement
+    Stats *RoundStats
+    Work []RelayedWork
+    Clock *ClockSample
+    Target []byte
+    Nodes []Contact
+    Error *ProtocolError
+}
+
+type Hello struct {
+    MinVersion uint
+    MaxVersion uint
+    // The actions that are handled.
+    Capabilities []string
+    // The address of the sender, empty when it does not listen or does not
+    // know its host yet.
+    Address string
+    // In answers, the address that the request came from.
+    Observed string
+}
+
+type Announcement struct {
+    Round int64
+    Next time.Time
+    Interval time.Duration
+}
+
+type RoundStats struct {
+    Round int64
+    Precomputed uint64
+    Outcomes OutcomeCounts
+}
+
+// The work of a frontier. Requests leave Work empty and say the Difficulty
+// that it has to meet.
+type RelayedWork struct {
+    Hash string
+    Work string
+    Difficulty string
+}
+
+type ProtocolError struct {
+    Code string
+    Message string
+}
+
+func (e *ProtocolError) Error() (string) {
+    return e.Code + ": " + e.Message
+}
+
+// The handlers of every action but hello, which starts every connection.
+var Handlers = map[string]func(c *PeerConn, m Message) (Message){
+    ActionGetPeers: handleGetPeers,
+    ActionAnnounceSchedule: handleAnnounceSchedule,
+    ActionGetSchedule: handleGetSchedule,
+    ActionReportRoundStats: handleReportRoundStats,
+    ActionRelayPoW: handleRelayPoW,
+    ActionTimeSync: handleTimeSync,
+    ActionFindNode: handleFindNode,
+}
+
+var ErrSelf = errors.New("the peer is this node")
+var ErrWrongSigner = errors.New("the frame is not signed by the identity of the connection")
+
+var pLock sync.Mutex
+
+// What the peers told us, by identity.
+var PeerRounds = make(map[string]RoundStats)
+
+// A connection to a peer, from either side.
+type PeerConn struct {
+    conn net.Conn
+    enc *gob.Encoder
+    dec *gob.Decoder
+    // Limits the size of every received message.
+    limit *limitReader
+    // The negotiated version, 0 before hello.
+    version uint
+    capabilities []string
+    lastID uint64
+    // The identity of the peer, from its certificate.
+    key string
+    // The address the peer advertised or was dialed at, empty when it does
+    // not listen.
+    address string
+}
+
+// newPeerConn finishes the handshake of a connection.
+func newPeerConn(conn *tls.Conn) (*PeerConn, error) {
+    key, err := peerKey(conn)
+    if err != nil {
+        return nil, err
+    }
+    limit := &limitReader{conn, MaxMessageSize}
+    return &PeerConn{conn: conn, enc: gob.NewEncoder(conn), dec: gob.NewDecoder(limit), limit: limit, key: key}, nil
+}
+
+// name returns the address of the peer, or its identity if it has none.
+func (c *PeerConn) name() (string) {
+    if (c.address != "") {
+        return c.address
+    }
+    return c.key
+}
+
+// send signs a message and sends it.
+func (c *PeerConn) send(m Message) (error) {
+    f, err := seal(m)
+    if err != nil {
+        return err
+    }
+    return c.enc.Encode(f)
+}
+
+// receive returns the next message that is signed by the identity of the peer.
+func (c *PeerConn) receive() (Message, error) {
+    var f Frame
+    c.limit.n = MaxMessageSize
+    err := c.dec.Decode(&f)
+    if err != nil {
+        return Message{}, err
+    }
+    m, key, err := unseal(f)
+    if err != nil {
+        return Message{}, err
+    }
+    if (c.key != key) {
+        return Message{}, ErrWrongSigner
+    }
+    return m, nil
+}
+
+func localHello() (*Hello) {
+    capabilities := make([]string, 0, len(Handlers))
+    for action := range Handlers {
+        capabilities = append(capabilities, action)
+    }
+    sort.Strings(capabilities)
+    return &Hello{MinVersion: MinProtocolVersion, MaxVersion: ProtocolVersion, Capabilities: capabilities, Address: advertised()}
+}
+
+// negotiate returns the highest version that both sides speak.
+func negotiate(h Hello) (uint, bool) {
+    v := uint(ProtocolVersion)
+    if (h.MaxVersion < v) {
+        v = h.MaxVersion
+    }
+    if (v < MinProtocolVersion || v < h.MinVersion) {
+        return 0, false
+    }
+    return v, true
+}
+
+func protocolError(code string, a ...interface{}) (Message) {
+    return Message{Header: Header{Action: ActionError}, Error: &ProtocolError{code, fmt.Sprint(a...)}}
+}
+
+func ack() (Message) {
+    return Message{Header: Header{Action: ActionAck}}
+}
+
+// Call sends a request and waits for its answer. An error answer is returned
+// as a *ProtocolError.
+func (c *PeerConn) Call(action string, m Message) (Message, error) {
+    c.lastID++
+    m.Header = Header{Version: c.version, ID: c.lastID, Action: action}
+    c.conn.SetDeadline(time.Now().Add(PeerCallTimeout))
+    err := c.send(m)
+    if err != nil {
+        return Message{}, err
+    }
+    for {
+        r, err := c.receive()
+        if err != nil {
+            return Message{}, err
+        }
+        if (r.Header.Reply != m.Header.ID) {
+            // The answer to an earlier request that was given up on.
+            continue
+        }
+        if (r.Error != nil) {
+            return r, r.Error
+        }
+        return r, nil
+    }
+}
+
+// dialPeer connects to a peer at host:port and says hello.
+func dialPeer(address string) (*PeerConn, error) {
+    conn, err := dialTLS(address)
+    if err != nil {
+        peerFailed(address)
+        return nil, err
+    }
+    c, err := newPeerConn(conn)
+    if (err == nil && c.key == NodeKey()) {
+        conn.Close()
+        forgetPeer(address)
+        return nil, ErrSelf
+    }
+    if err != nil {
+        conn.Close()
+        peerFailed(address)
+        return nil, err
+    }
+    c.address = address
+    c.version = ProtocolVersion
+    start := time.Now()
+    r, err := c.Call(ActionHello, Message{Hello: localHello()})
+    rtt := time.Since(start)
+    if (err == nil && (r.Hello == nil || r.Header.Version < MinProtocolVersion || r.Header.Version > ProtocolVersion)) {
+        err = fmt.Errorf("%s answered hello with version %d", address, r.Header.Version)
+    }
+    if err != nil {
+        conn.Close()
+        peerFailed(address)
+        return nil, err
+    }
+    c.version = r.Header.Version
+    c.capabilities = r.Hello.Capabilities
+    learnAddress(r.Hello.Observed)
+    peerSeen(c, rtt)
+    routeSeen(c)
+    return c, nil
+}
+
+// Capable reports whether the peer handles an action.
+func (c *PeerConn) Capable(action string) (bool) {
+    for _, a := range c.capabilities {
+        if (a == action) {
+            return true
+        }
+    }
+    return false
+}
+
+// request makes a single request of a peer.
+func request(address, action string, m Message) (Message, error) {
+    // The purpose of this function is to make requests to other nodes on the network.
+    if (address == advertised()) {
+        // Don't make requests to ourselves.
+        return Message{}, ErrSelf
+    }
+    c, err := dialPeer(address)
+    if err != nil {
+        return Message{}, err
+    }
+    defer c.conn.Close()
+    if (!c.Capable(action)) {
+        return Message{}, fmt.Errorf("%s does not handle %s", address, action)
+    }
+    return c.Call(action, m)
+}
+
+// broadcast makes the same request of every known peer.
+func broadcast(action string, m Message) {
+    for _, address := range peerList() {
+        go func(address string) {
+            _, err := request(address, action, m)
+            if err != nil {
+                fmt.Println("Error: Peer", address, action, err)
+            }
+        }(address)
+    }
+}
+
+// handle returns the answer to a message.
+func (c *PeerConn) handle(m Message) (Message) {
+    if (m.Header.Action == ActionHello) {
+        if (m.Hello == nil) {
+            return protocolError(ErrCodeBadRequest, "hello without a body")
+        }
+        v, ok := negotiate(*m.Hello)
+        if (!ok) {
+            return protocolError(ErrCodeVersion, "this node speaks versions ", MinProtocolVersion, " to ", ProtocolVersion)
+        }
+        c.version = v
+        c.capabilities = m.Hello.Capabilities
+        if address := helloAddress(c.conn, m.Hello.Address); (address != "") {
+            // Add the peer to the list of known Peers.
+            c.address = address
+            peerHeard(c)
+            routeSeen(c)
+        }
+        r := Message{Header: Header{Action: ActionHello}, Hello: localHello()}
+        r.Hello.Observed = c.conn.RemoteAddr().String()
+        return r
+    }
+    if (c.version == 0) {
+        return protocolError(ErrCodeHelloRequired, "say hello first")
+    }
+    if (m.Header.Version != c.version) {
+        return protocolError(ErrCodeVersion, "the connection uses version ", c.version)
+    }
+    handler, ok := Handlers[m.Header.Action]
+    if (!ok) {
+        return protocolError(ErrCodeUnknownAction, m.Header.Action)
+    }
+    return handler(c, m)
+}
+
+func handleGetPeers(c *PeerConn, m Message) (Message) {
+    r := Message{Header: Header{Action: ActionGetPeers}}
+    r.Peers = peerList()
+    if self := advertised(); (self != "") {
+        r.Peers = append(r.Peers, self)
+    }
+    return r
+}
+
+func handleAnnounceSchedule(c *PeerConn, m Message) (Message) {
+    if (m.Schedule == nil) {
+        return protocolError(ErrCodeBadRequest, "announce_schedule without a schedule")
+    }
+    if (!usable(*m.Schedule)) {
+        return protocolError(ErrCodeBadRequest, "announce_schedule with interval ", m.Schedule.Interval, " and next attack ", m.Schedule.Next)
+    }
+    // One identity is one vote in the median, whatever it connects from.
+    if (c.key == "") {
+        return protocolError(ErrCodeBadRequest, "announce_schedule without an identity")
+    }
+    pLock.Lock()
+    Announced[c.key] = PeerSchedule{*m.Schedule, clusterNow()}
+    pLock.Unlock()
+    return ack()
+}
+
+func handleReportRoundStats(c *PeerConn, m Message) (Message) {
+    if (m.Stats == nil) {
+        return protocolError(ErrCodeBadRequest, "report_round_stats without stats")
+    }
+    if (c.key == "") {
+        return protocolError(ErrCodeBadRequest, "report_round_stats without an identity")
+    }
+    pLock.Lock()
+    PeerRounds[c.key] = *m.Stats
+    pLock.Unlock()
+    fmt.Println("Peer", c.name(), "Round:", m.Stats.Round, "Precomputed:", m.Stats.Precomputed, "Outcomes:", m.Stats.Outcomes)
+    return ack()
+}
@@ -0,0 +1,303 @@
+/*
+ * Copyright (C) 2018 Keaton Bruce
+ *
+ * This file is part of nano-prepowtx.
+ *
+ * nano-prepowtx is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * nano-prepowtx is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with nano-prepowtx. If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+    "fmt"
+    "os"
+    "sort"
+    "sync"
+    "time"
+    "io/ioutil"
+    "encoding/json"
+)
+
+/*
+ * The peer table keeps what is known about every peer. Every dial updates it:
+ * a hello that is answered makes the peer live and records its round trip,
+ * identity, version and capabilities, a dial that fails counts a failure.
+ *
+ * Every PingInterval the peers that are due are dialed, at most MaxDials at
+ * once, and the DHT is refreshed to find new peers (see dht.go). A peer that
+ * fails is not dialed again for PingInterval, doubled for every further
+ * failure up to MaxBackoff, and is forgotten once it has failed MaxFailures
+ * times and was not seen for ForgetAfter. The table is saved after every
+ * round of pings and loaded at startup, so a restarted instance reconnects to
+ * the peers it knew.
+ */
+
+const PingInterval = 30 * time.Second
+const MaxDials = 8
+const MaxBackoff = time.Hour
+const MaxFailures = 8
+const ForgetAfter = 24 * time.Hour
+
+type PeerInfo struct {
+    Address string `json:"address"`
+    Key string `json:"key,omitempty"`
+    LastSeen time.Time `json:"last_seen"`
+    Failures int `json:"failures"`
+    RTT time.Duration `json:"rtt"`
+    Version uint `json:"version,omitempty"`
+    Capabilities []string `json:"capabilities,omitempty"`
+    // The last dial and when the next one is due.
+    Dialed time.Time `json:"dialed"`
+    NextDial time.Time `json:"next_dial"`
+}
+
+// The known peers, by the address they advertise.
+var peers = make(map[string]*PeerInfo)
+
+// live reports whether a peer answered its last dial, or was never dialed.
+func (p *PeerInfo) live() (bool) {
+    return p.Failures == 0
+}
+
+// addPeer adds a peer that is not known yet. It is dialed with the next pings.
+func addPeer(address string) (bool) {
+    pLock.Lock()
+    defer pLock.Unlock()
+    if _, ok := peers[address]; ok {
+        return false
+    }
+    peers[address] = &PeerInfo{Address: address}
+    return true
+}
+
+// peerSeen records a peer that answered hello.
+func peerSeen(c *PeerConn, rtt time.Duration) {
+    pLock.Lock()
+    defer pLock.Unlock()
+    p, ok := peers[c.address]
+    if (!ok) {
+        p = &PeerInfo{Address: c.address}
+        peers[c.address] = p
+    }
+    now := time.Now()
+    p.Key = c.key
+    p.LastSeen = now
+    p.Failures = 0
+    p.RTT = rtt
+    p.Version = c.version
+    p.Capabilities = c.capabilities
+    p.Dialed = now
+    p.NextDial = now.Add(PingInterval)
+}
+
+// peerHeard records a peer that said hello to us. It is not dialed, so its
+// failures are left alone.
+func peerHeard(c *PeerConn) {
+    pLock.Lock()
+    defer pLock.Unlock()
+    p, ok := peers[c.address]
+    if (!ok) {
+        p = &PeerInfo{Address: c.address}
+        peers[c.address] = p
+    }
+    p.Key = c.key
+    p.LastSeen = time.Now()
+    p.Capabilities = c.capabilities
+    p.Version = c.version
+}
+
+// peerFailed records a dial that failed and backs the peer off.
+func peerFailed(address string) {
+    pLock.Lock()
+    defer pLock.Unlock()
+    p, ok := peers[address]
+    if (!ok) {
+        return
+    }
+    now := time.Now()
+    p.Failures++
+    p.Dialed = now
+    backoff := PingInterval
+    for i := 1; i < p.Failures && backoff < MaxBackoff; i++ {
+        backoff *= 2
+    }
+    if (backoff > MaxBackoff) {
+        backoff = MaxBackoff
+    }
+    p.NextDial = now.Add(backoff)
+    if (p.Failures >= MaxFailures && now.Sub(p.LastSeen) > ForgetAfter) {
+        delete(peers, address)
+    }
+}
+
+// forgetPeer removes a peer, such as our own address.
+func forgetPeer(address string) {
+    pLock.Lock()
+    delete(peers, address)
+    pLock.Unlock()
+}
+
+// peerList returns the addresses of the live peers but this node.
+func peerList() ([]string) {
+    self := advertised()
+    pLock.Lock()
+    defer pLock.Unlock()
+    addresses := make([]string, 0, len(peers))
+    for address, p := range peers {
+        if (address != self && p.live()) {
+            addresses = append(addresses, address)
+        }
+    }
+    sort.Strings(addresses)
+    return addresses
+}
+
+// duePeers returns the addresses of the peers that are due to be dialed.
+func duePeers(onlyNew bool) ([]string) {
+    now := time.Now()
+    pLock.Lock()
+    defer pLock.Unlock()
+    var addresses []string
+    for address, p := range peers {
+        if (onlyNew && !p.Dialed.IsZero()) {
+            continue
+        }
+        if (!p.NextDial.After(now)) {
+            addresses = append(addresses, address)
+        }
+    }
+    return addresses
+}
+
+// pingPeers dials the peers that are due.
+func pingPeers(onlyNew bool) (int) {
+    addresses := duePeers(onlyNew)
+    slots := make(chan struct{}, MaxDials)
+    var wg sync.WaitGroup
+    for _, address := range addresses {
+        slots <- struct{}{}
+        wg.Add(1)
+        go func(address string) {
+            defer wg.Done()
+            pingPeer(address)
+            <-slots
+        }(address)
+    }
+    wg.Wait()
+    return len(addresses)
+}
+
+// bootstrapPeers joins the DHT through the seeds and the peers of an
+// earlier run, and dials the peers it finds.
+func bootstrapPeers(seeds []string) {
+    receivePeers(seeds)
+    joinDHT(append(seeds, peerList()...))
+    pingPeers(true)
+}
+
+// maintainPeers pings the peers and saves the table until the campaign stops.
+func maintainPeers(path string) {
+    ticker := time.NewTicker(PingInterval)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-ticker.C:
+        case <-Campaign.Done():
+            savePeers(path)
+            return
+        }
+        pingPeers(false)
+        lookup(SelfID)
+        refreshDHT()
+        savePeers(path)
+    }
+}
+
+// pingPeer says hello to a peer, which updates the peer table.
+func pingPeer(address string) {
+    c, err := dialPeer(address)
+    if err != nil {
+        fmt.Println("Error: Peer", address, err)
+        return
+    }
+    c.conn.Close()
+}
+
+// receivePeers adds the addresses that are not known yet.
+func receivePeers(addresses []string) {
+    self := advertised()
+    for _, k := range addresses {
+        k, err := peerAddress(k, PeerPort)
+        if (err != nil || k == self) {
+            continue
+        }
+        if (addPeer(k)) {
+            fmt.Println("New Peer:", k)
+        }
+    }
+}
+
+// savePeers writes the peer table.
+func savePeers(path string) {
+    if (path == "") {
+        return
+    }
+    pLock.Lock()
+    table := make([]PeerInfo, 0, len(peers))
+    for _, p := range peers {
+        table = append(table, *p)
+    }
+    pLock.Unlock()
+    sort.Slice(table, func(i, j int) bool { return table[i].Address < table[j].Address })
+    b, err := json.MarshalIndent(table, "", "    ")
+    if err == nil {
+        err = ioutil.WriteFile(path + ".tmp", b, 0644)
+    }
+    if err == nil {
+        err = os.Rename(path + ".tmp", path)
+    }
+    if err != nil {
+        fmt.Println("Error: Unable to save the peers:", err)
+    }
+}
+
+// loadPeers reads the peer table, if there is one. The known peers are
+// dialed right away.
+func loadPeers(path string) {
+    if (path == "") {
+        return
+    }
+    b, err := ioutil.ReadFile(path)
+    if os.IsNotExist(err) {
+        return
+    }
+    var table []PeerInfo
+    if err == nil {
+        err = json.Unmarshal(b, &table)
+    }
+    if err != nil {
+        fmt.Println("Error: Unable to load the peers:", err)
+        return
+    }
+    pLock.Lock()
+    for i := range table {
+        p := table[i]
+        p.Dialed = time.Time{}
+        p.NextDial = time.Time{}
+        peers[p.Address] = &p
+    }
+    pLock.Unlock()
+    fmt.Println("Loaded", len(table), "Peers from:", path)
+}
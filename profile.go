@@ -0,0 +1,285 @@
+/*
+ * Copyright (C) 2018 Keaton Bruce
+ *
+ * This file is part of nano-prepowtx.
+ *
+ * nano-prepowtx is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * nano-prepowtx is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with nano-prepowtx. If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+    "fmt"
+    "os"
+    "math"
+    "time"
+    "strings"
+    "strconv"
+    "context"
+    "encoding/csv"
+)
+
+/*
+ * A load profile drives the publish rate over the time of a round, so the
+ * rate where the node starts to degrade can be found in a single campaign.
+ *
+ * Profiles are given as name:key=value,key=value
+ *
+ * ramp:from=10,to=100,length=10m
+ *     A linear ramp from one rate to another.
+ * step:from=10,step=10,every=1m,steps=5
+ *     A staircase that starts at from and goes up by step every interval.
+ * spike:base=10,peak=200,every=1m,width=5s,length=10m
+ *     The base rate with a spike to the peak rate at the start of every interval.
+ * sine:mean=50,amplitude=40,period=2m,length=10m
+ *     A sinusoid around the mean rate.
+ * trace:file=load.csv
+ *     A replayed trace of seconds,tps rows. Every rate lasts until the
+ *     next row and the last row ends the trace.
+ *
+ * Every round precomputes the total number of blocks of the profile.
+ */
+
+type LoadProfile interface {
+    // Rate returns the target TPS at time t since the start of publishing.
+    Rate(t time.Duration) float64
+    // Length returns how long the profile lasts.
+    Length() time.Duration
+}
+
+// The load profile of the campaign, nil publishes at a fixed rate.
+var Profile LoadProfile
+
+// ProfileBlocks returns the total number of blocks that a profile publishes.
+func ProfileBlocks(p LoadProfile) (uint64) {
+    const step = 10 * time.Millisecond
+    var total float64
+    for t := time.Duration(0); t < p.Length(); t += step {
+        total += p.Rate(t) * step.Seconds()
+    }
+    return uint64(math.Ceil(total))
+}
+
+type Ramp struct {
+    From, To float64
+    length time.Duration
+}
+
+func (p Ramp) Rate(t time.Duration) (float64) {
+    if (t >= p.length) {
+        return p.To
+    }
+    return p.From + (p.To - p.From) * float64(t) / float64(p.length)
+}
+
+func (p Ramp) Length() (time.Duration) {
+    return p.length
+}
+
+type Step struct {
+    From, Step float64
+    Every time.Duration
+    Steps int64
+}
+
+func (p Step) Rate(t time.Duration) (float64) {
+    n := int64(t / p.Every)
+    if (n >= p.Steps) {
+        n = p.Steps - 1
+    }
+    return p.From + p.Step * float64(n)
+}
+
+func (p Step) Length() (time.Duration) {
+    return p.Every * time.Duration(p.Steps)
+}
+
+type Spike struct {
+    Base, Peak float64
+    Every, Width time.Duration
+    length time.Duration
+}
+
+func (p Spike) Rate(t time.Duration) (float64) {
+    if (t % p.Every < p.Width) {
+        return p.Peak
+    }
+    return p.Base
+}
+
+func (p Spike) Length() (time.Duration) {
+    return p.length
+}
+
+type Sine struct {
+    Mean, Amplitude float64
+    Period time.Duration
+    length time.Duration
+}
+
+func (p Sine) Rate(t time.Duration) (float64) {
+    rate := p.Mean + p.Amplitude * math.Sin(2 * math.Pi * float64(t) / float64(p.Period))
+    if (rate < 0) {
+        return 0
+    }
+    return rate
+}
+
+func (p Sine) Length() (time.Duration) {
+    return p.length
+}
+
+type Trace struct {
+    Times []time.Duration
+    Rates []float64
+}
+
+func (p Trace) Rate(t time.Duration) (float64) {
+    rate := 0.0
+    for i, at := range p.Times {
+        if (at > t) {
+            break
+        }
+        rate = p.Rates[i]
+    }
+    return rate
+}
+
+func (p Trace) Length() (time.Duration) {
+    return p.Times[len(p.Times) - 1]
+}
+
+func readTrace(path string) (Trace) {
+    var p Trace
+    f, err := os.Open(path)
+    if err != nil {
+        fmt.Println(err)
+        os.Exit(1)
+    }
+    defer f.Close()
+
+    rows, err := csv.NewReader(f).ReadAll()
+    if err != nil {
+        fmt.Println("Error: Unable to read trace:", err)
+        os.Exit(1)
+    }
+    for i, row := range rows {
+        if (len(row) != 2) {
+            fmt.Println("Error: Trace row", i + 1, "should be seconds,tps")
+            os.Exit(1)
+        }
+        seconds, err1 := strconv.ParseFloat(strings.TrimSpace(row[0]), 64)
+        rate, err2 := strconv.ParseFloat(strings.TrimSpace(row[1]), 64)
+        if (err1 != nil || err2 != nil) {
+            if (i == 0) {
+                // A header.
+                continue
+            }
+            fmt.Println("Error: Trace row", i + 1, "should be seconds,tps")
+            os.Exit(1)
+        }
+        at := time.Duration(seconds * float64(time.Second))
+        if (len(p.Times) > 0 && at <= p.Times[len(p.Times) - 1]) {
+            fmt.Println("Error: Trace row", i + 1, "is not after the row before it")
+            os.Exit(1)
+        }
+        p.Times = append(p.Times, at)
+        p.Rates = append(p.Rates, rate)
+    }
+    if (len(p.Times) < 2) {
+        fmt.Println("Error: A trace needs at least two rows")
+        os.Exit(1)
+    }
+    return p
+}
+
+// ParseProfile reads a profile from its description.
+func ParseProfile(spec string) (LoadProfile) {
+    name := spec
+    args := make(map[string]string)
+    if i := strings.Index(spec, ":"); i >= 0 {
+        name = spec[:i]
+        for _, kv := range strings.Split(spec[i + 1:], ",") {
+            pair := strings.SplitN(kv, "=", 2)
+            if (len(pair) != 2) {
+                fmt.Println("Error: Invalid profile argument:", kv)
+                os.Exit(1)
+            }
+            args[strings.TrimSpace(pair[0])] = strings.TrimSpace(pair[1])
+        }
+    }
+
+    rate := func(key string) (float64) {
+        v, err := strconv.ParseFloat(args[key], 64)
+        if err != nil || v < 0 {
+            fmt.Println("Error: The", name, "profile needs a rate for", key)
+            os.Exit(1)
+        }
+        return v
+    }
+    duration := func(key string) (time.Duration) {
+        v, err := time.ParseDuration(args[key])
+        if err != nil || v <= 0 {
+            fmt.Println("Error: The", name, "profile needs a duration for", key)
+            os.Exit(1)
+        }
+        return v
+    }
+
+    switch name {
+    case "ramp":
+        return Ramp{rate("from"), rate("to"), duration("length")}
+    case "step":
+        steps, err := strconv.ParseInt(args["steps"], 10, 64)
+        if err != nil || steps < 1 {
+            fmt.Println("Error: The step profile needs a number of steps")
+            os.Exit(1)
+        }
+        return Step{rate("from"), rate("step"), duration("every"), steps}
+    case "spike":
+        return Spike{rate("base"), rate("peak"), duration("every"), duration("width"), duration("length")}
+    case "sine":
+        return Sine{rate("mean"), rate("amplitude"), duration("period"), duration("length")}
+    case "trace":
+        return readTrace(args["file"])
+    }
+    fmt.Println("Error: Unknown load profile:", name)
+    os.Exit(1)
+    return nil
+}
+
+// paceProfile sets the limiter to the rate of the profile at the time since
+// begin. A rate of zero waits until the profile picks up again, or returns
+// the error of the context when it is done first. After the end of the
+// profile the rest of the blocks are published without a limit.
+func paceProfile(ctx context.Context, begin time.Time) (error) {
+    for {
+        t := time.Since(begin)
+        if (t >= Profile.Length()) {
+            Limiter.SetRate(0)
+            return nil
+        }
+        rate := Profile.Rate(t)
+        if (rate > 0) {
+            Limiter.SetRate(rate)
+            return nil
+        }
+        select {
+        case <-time.After(10 * time.Millisecond):
+        case <-ctx.Done():
+            return ctx.Err()
+        }
+    }
+}
@@ -0,0 +1,179 @@
+/*
+ * Copyright (C) 2018 Keaton Bruce
+ *
+ * This file is part of nano-prepowtx.
+ *
+ * nano-prepowtx is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * nano-prepowtx is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with nano-prepowtx. If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+    "fmt"
+    "sync"
+    "time"
+    "context"
+    "sync/atomic"
+)
+
+/*
+ * Publishing is paced by a token bucket. Tokens are added at the target rate
+ * up to the burst size, and every published block takes one token. When the
+ * bucket is empty the publisher sleeps until the next token is due, so the
+ * achieved rate stays at the target over time instead of only on average.
+ *
+ * A rate of zero does not limit publishing at all.
+ *
+ * The achieved rate is reported every second of wall-clock time, also when
+ * less than one block a second is published.
+ */
+
+type TokenBucket struct {
+    mu sync.Mutex
+    rate float64
+    burst float64
+    tokens float64
+    last time.Time
+}
+
+// The limiter of the publish path, nil publishes as fast as possible.
+var Limiter *TokenBucket
+
+func NewTokenBucket(rate float64, burst uint64) (*TokenBucket) {
+    if (burst < 1) {
+        burst = 1
+    }
+    return &TokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+func (b *TokenBucket) Rate() (float64) {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    return b.rate
+}
+
+// SetRate changes the target rate. The tokens that were earned at the old
+// rate are kept.
+func (b *TokenBucket) SetRate(rate float64) {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    b.refill(time.Now())
+    b.rate = rate
+}
+
+func (b *TokenBucket) refill(now time.Time) {
+    b.tokens += now.Sub(b.last).Seconds() * b.rate
+    if (b.tokens > b.burst) {
+        b.tokens = b.burst
+    }
+    b.last = now
+}
+
+// Wait blocks until a token is available and takes it. It returns the error
+// of the context, without a token, if the context is done first.
+func (b *TokenBucket) Wait(ctx context.Context) (error) {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    if (b.rate <= 0) {
+        return nil
+    }
+    b.refill(time.Now())
+    if (b.tokens < 1) {
+        // Sleep for exactly the time until the token is due. The token is
+        // counted from the time it was due, not from when the sleep ended,
+        // so oversleeping does not lower the rate.
+        due := time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+        timer := time.NewTimer(due)
+        b.mu.Unlock()
+        select {
+        case <-timer.C:
+        case <-ctx.Done():
+            timer.Stop()
+            b.mu.Lock()
+            return ctx.Err()
+        }
+        b.mu.Lock()
+        b.refill(b.last.Add(due))
+        if (b.tokens < 1) {
+            b.tokens = 1
+        }
+    }
+    b.tokens--
+    return nil
+}
+
+// Allow takes a token if one is available, without waiting for one.
+func (b *TokenBucket) Allow() (bool) {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    if (b.rate <= 0) {
+        return true
+    }
+    b.refill(time.Now())
+    if (b.tokens < 1) {
+        return false
+    }
+    b.tokens--
+    return true
+}
+
+// RateMeter counts published blocks and reports the achieved rate every second
+// until it is stopped.
+type RateMeter struct {
+    count uint64
+    stop chan struct{}
+    done chan struct{}
+}
+
+func NewRateMeter() (*RateMeter) {
+    m := &RateMeter{stop: make(chan struct{}), done: make(chan struct{})}
+    go m.report()
+    return m
+}
+
+// Add counts a block.
+func (m *RateMeter) Add() {
+    atomic.AddUint64(&m.count, 1)
+}
+
+// Stop ends the reports.
+func (m *RateMeter) Stop() {
+    close(m.stop)
+    <-m.done
+}
+
+func (m *RateMeter) report() {
+    defer close(m.done)
+    ticker := time.NewTicker(time.Second)
+    defer ticker.Stop()
+    last := time.Now()
+    var second uint64
+    for {
+        var now time.Time
+        select {
+        case now = <-ticker.C:
+        case <-m.stop:
+            return
+        }
+        second++
+        achieved := float64(atomic.SwapUint64(&m.count, 0)) / now.Sub(last).Seconds()
+        last = now
+        if (Limiter != nil && Limiter.Rate() > 0) {
+            fmt.Printf("\nSecond %d: %.1f TPS achieved, %.1f TPS target\n", second, achieved, Limiter.Rate())
+        } else {
+            fmt.Printf("\nSecond %d: %.1f TPS achieved\n", second, achieved)
+        }
+    }
+}
@@ -28,11 +28,13 @@ import (
     "io/ioutil"
     "bytes"
     "time"
+    "errors"
 )
 
 /*
  * This file is split up between json structs and functions that supply those structs.
  * MakeRequest and Unmarshal deal with handling generic requests and responses.
+ * TryRequest is for the requests whose errors are not fatal.
  * The other functions are designed specifically to handle their specific request
  * but most of them follow the same basic structure.
  */
@@ -42,6 +44,10 @@ type RPCRequest struct {
     Action string `json:"action"`
 }
 
+// The nano-node RPC servers. Blocks can be published to all of them,
+// every other request goes to the first one.
+var Nodes = []string{"http://localhost:7076"}
+
 // MakeRequest handles any json struct and sends those requests over
 // HTTP POST to the nano-node server.
 // It then reads the response body and returns it as a byte array.
@@ -53,26 +59,48 @@ func MakeRequest(data interface{}) ([]byte) {
     }
     //fmt.Println(string(bArr))
 
-    buf := bytes.NewBuffer(bArr)
-    var client *http.Response
-    client, err = http.Post("http://localhost:7076", "text/json", buf)
+    b, err := Post(Nodes[0], bArr)
 
     for err != nil {
         fmt.Println(err)
         fmt.Println("Trying again in 10 seconds")
         time.Sleep(time.Duration(10) * time.Second)
-        client, err = http.Post("http://localhost:7076", "text/json", buf)
+        b, err = Post(Nodes[0], bArr)
     }
+    //fmt.Println(string(b))
 
-    var b []byte
-    b, err = ioutil.ReadAll(client.Body)
+    return b
+}
+
+// Post sends a single request to a nano-node server and returns the response body.
+func Post(url string, bArr []byte) ([]byte, error) {
+    client, err := http.Post(url, "text/json", bytes.NewBuffer(bArr))
     if err != nil {
-        fmt.Println(err)
-        os.Exit(1)
+        return nil, err
     }
-    //fmt.Println(string(b))
+    defer client.Body.Close()
 
-    return b
+    return ioutil.ReadAll(client.Body)
+}
+
+// TryRequest sends a request to the first node once and reads the response
+// into v. Unlike MakeRequest and Unmarshal it returns every error, including
+// an error of the node, instead of exiting.
+func TryRequest(data interface{}, v interface{}) (error) {
+    bArr, err := json.Marshal(data)
+    if err != nil {
+        return err
+    }
+    a, err := Post(Nodes[0], bArr)
+    if err != nil {
+        return err
+    }
+    var eres EResponse
+    json.Unmarshal(a, &eres)
+    if (eres.Error != "") {
+        return errors.New(eres.Error)
+    }
+    return json.Unmarshal(a, v)
 }
 
 type EResponse struct {
@@ -111,6 +139,8 @@ type BSRequest struct {
     Balance string `json:"balance"`
     Amount string `json:"amount"`
     Previous string `json:"previous"`
+    // Empty has the node compute the work.
+    Work string `json:"work,omitempty"`
 }
 
 // Create receive block request.
@@ -121,12 +151,16 @@ type BRRequest struct {
     Account string `json:"account"`
     Source string `json:"source"`
     Previous string `json:"previous"`
+    // Empty has the node compute the work.
+    Work string `json:"work,omitempty"`
 }
 
 // Create block response.
 type BCResponse struct {
     Hash string `json:"hash"`
     Block string `json:"block"`
+    // Only reported by newer nodes.
+    Difficulty string `json:"difficulty"`
 }
 
 type Block struct {
@@ -138,14 +172,22 @@ type Block struct {
     Signature string `json:"signature"`
 }
 
+type RBlock struct {
+    Type string `json:"type"`
+    Previous string `json:"previous"`
+    Source string `json:"source"`
+    Work string `json:"work"`
+    Signature string `json:"signature"`
+}
+
 // Account balance request.
 type ABRequest struct {
     Action string `json:"action"`
     Account string `json:"account"`
 }
 
-func CreateSendBlock(account string, dest string, balance string, amount string, previous string) (string, string) {
-    bsreq := BSRequest{"block_create", "send", Wallet, account, dest, balance, amount, previous}
+func CreateSendBlock(account string, dest string, balance string, amount string, previous string, work string) (string, string, string) {
+    bsreq := BSRequest{"block_create", "send", Wallet, account, dest, balance, amount, previous, work}
 
     // Get the balance if it is unknown.
     if (balance == "") {
@@ -171,11 +213,11 @@ func CreateSendBlock(account string, dest string, balance string, amount string,
     var bcres BCResponse
     Unmarshal(a, &bcres)
 
-    return bcres.Hash, bcres.Block
+    return bcres.Hash, bcres.Block, bcres.Difficulty
 }
 
-func CreateReceiveBlock(account string, source string, previous string) (string, string) {
-    brreq := BRRequest{"block_create", "receive", Wallet, account, source, previous}
+func CreateReceiveBlock(account string, source string, previous string, work string) (string, string, string) {
+    brreq := BRRequest{"block_create", "receive", Wallet, account, source, previous, work}
 
     // Find the last block hashes with Account_List if it is unknown.
     // From that point keep track of the block hashes.
@@ -189,7 +231,7 @@ func CreateReceiveBlock(account string, source string, previous string) (string,
     var bcres BCResponse
     Unmarshal(a, &bcres)
 
-    return bcres.Hash, bcres.Block
+    return bcres.Hash, bcres.Block, bcres.Difficulty
 }
 
 // Process block request and response.
@@ -213,6 +255,28 @@ func ProcessBlock(blk string) (string) {
     return pbres.Hash
 }
 
+// PublishBlock processes a block on one node without retrying or exiting.
+// A rejected block returns the error of the node, a failed request returns err.
+func PublishBlock(url string, blk string) (hash string, rejected string, err error) {
+    bArr, err := json.Marshal(PBRequest{"process", blk})
+    if err != nil {
+        return "", "", err
+    }
+    a, err := Post(url, bArr)
+    if err != nil {
+        return "", "", err
+    }
+
+    var eres EResponse
+    json.Unmarshal(a, &eres)
+    if (eres.Error != "") {
+        return "", eres.Error, nil
+    }
+    var pbres PBResponse
+    err = json.Unmarshal(a, &pbres)
+    return pbres.Hash, "", err
+}
+
 // Account history request and response.
 type AHRequest struct {
     Action string `json:"action"`
@@ -322,7 +386,7 @@ type ACRequest struct {
 }
 
 type ACRespone struct {
-    Account string `json:account"`
+    Account string `json:"account"`
 }
 
 // Make a request to generate a single account with the wallet.
@@ -401,3 +465,165 @@ func GetBalances() (map[string]WABalance) {
 
     return wares.Balances
 }
+
+// Accounts frontiers request and response.
+type AFRequest struct {
+    Action string `json:"action"`
+    Accounts []string `json:"accounts"`
+}
+
+type AFResponse struct {
+    Frontiers map[string]string `json:"frontiers"`
+}
+
+// GetFrontiers returns the most recent block hash for each of the accounts.
+// Accounts that have not been opened are missing from the map.
+func GetFrontiers(accounts []string) (map[string]string) {
+    afreq := AFRequest{"accounts_frontiers", accounts}
+
+    a := MakeRequest(afreq)
+
+    var afres AFResponse
+    Unmarshal(a, &afres)
+
+    return afres.Frontiers
+}
+
+// Work validate request and response.
+type WVRequest struct {
+    Action string `json:"action"`
+    Work string `json:"work"`
+    Hash string `json:"hash"`
+}
+
+type WVResponse struct {
+    Valid string `json:"valid"`
+    Difficulty string `json:"difficulty"`
+}
+
+// ValidateWork returns the difficulty of the work for the root hash.
+// Older nodes only report whether the work is valid and return no difficulty.
+func ValidateWork(work, hash string) (string, error) {
+    wvreq := WVRequest{"work_validate", work, hash}
+
+    var wvres WVResponse
+    err := TryRequest(wvreq, &wvres)
+
+    return wvres.Difficulty, err
+}
+
+// Work generate request and response.
+type WGRequest struct {
+    Action string `json:"action"`
+    Hash string `json:"hash"`
+    // Empty uses the default difficulty of the node.
+    Difficulty string `json:"difficulty,omitempty"`
+}
+
+type WGResponse struct {
+    Work string `json:"work"`
+    Difficulty string `json:"difficulty"`
+}
+
+// GenerateWork computes new work for the root hash that is at least the difficulty.
+func GenerateWork(hash, difficulty string) (string, string, error) {
+    wgreq := WGRequest{"work_generate", hash, difficulty}
+
+    var wgres WGResponse
+    err := TryRequest(wgreq, &wgres)
+    if (err == nil && wgres.Work == "") {
+        err = errors.New("the node returned no work")
+    }
+
+    return wgres.Work, wgres.Difficulty, err
+}
+
+// Active difficulty response.
+type ADResponse struct {
+    NetworkMinimum string `json:"network_minimum"`
+    NetworkCurrent string `json:"network_current"`
+}
+
+// ActiveDifficulty returns the minimum and the current difficulty of the network.
+func ActiveDifficulty() (string, string, error) {
+    adreq := RPCRequest{"active_difficulty"}
+
+    var adres ADResponse
+    err := TryRequest(adreq, &adres)
+
+    return adres.NetworkMinimum, adres.NetworkCurrent, err
+}
+
+// Blocks info request and response.
+type BIRequest struct {
+    Action string `json:"action"`
+    Hashes []string `json:"hashes"`
+    IncludeNotFound string `json:"include_not_found"`
+}
+
+type BIResponse struct {
+    Blocks map[string]BIBlock `json:"blocks"`
+}
+
+type BIBlock struct {
+    Confirmed string `json:"confirmed"`
+}
+
+// GetConfirmed returns whether each of the blocks is confirmed.
+// Blocks that the node does not have are missing from the map.
+func GetConfirmed(hashes []string) (map[string]bool, error) {
+    bireq := BIRequest{"blocks_info", hashes, "true"}
+
+    var bires BIResponse
+    err := TryRequest(bireq, &bires)
+    if err != nil {
+        return nil, err
+    }
+
+    confirmed := make(map[string]bool, len(bires.Blocks))
+    for hash, info := range bires.Blocks {
+        confirmed[hash] = info.Confirmed == "true"
+    }
+    return confirmed, nil
+}
+
+// Block confirm request.
+type BCFRequest struct {
+    Action string `json:"action"`
+    Hash string `json:"hash"`
+}
+
+type BCFResponse struct {
+    Started string `json:"started"`
+}
+
+// ConfirmBlock asks the node to start an election for the block.
+func ConfirmBlock(hash string) (error) {
+    bcfreq := BCFRequest{"block_confirm", hash}
+
+    var bcfres BCFResponse
+    return TryRequest(bcfreq, &bcfres)
+}
+
+// Account info request and response.
+type AIRequest struct {
+    Action string `json:"action"`
+    Account string `json:"account"`
+}
+
+type AIResponse struct {
+    Frontier string `json:"frontier"`
+    Balance string `json:"balance"`
+    BlockCount string `json:"block_count"`
+}
+
+func AccountInfo(account string) (AIResponse) {
+    aireq := AIRequest{"account_info", account}
+
+    a := MakeRequest(aireq)
+
+    var aires AIResponse
+    Unmarshal(a, &aires)
+
+    return aires
+}
@@ -0,0 +1,152 @@
+/*
+ * Copyright (C) 2018 Keaton Bruce
+ *
+ * This file is part of nano-prepowtx.
+ *
+ * nano-prepowtx is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * nano-prepowtx is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with nano-prepowtx. If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+    "fmt"
+    "os"
+    "time"
+    "math/big"
+    "io/ioutil"
+    "encoding/json"
+)
+
+/*
+ * The schedule of a campaign. Every round precomputes blocks until the next
+ * attack and then publishes them. Without a start time the attacks are aligned
+ * to multiples of the interval in Unix time, so independent instances with the
+ * same interval attack at the same moment.
+ */
+
+type Schedule struct {
+    // The time to precompute a round of blocks.
+    Interval time.Duration
+    // The first attack. Zero aligns the attacks to Unix time.
+    Start time.Time
+    // The number of rounds to run, counted from the first round of this
+    // process. Zero runs forever.
+    Rounds int64
+    // The total duration of the campaign. Zero runs forever.
+    Duration time.Duration
+    // When the campaign began, the end is measured from here.
+    Began time.Time
+}
+
+// Next returns the time of the next attack after now.
+func (s Schedule) Next(now time.Time) (time.Time) {
+    if (s.Start.IsZero()) {
+        var timePastTest time.Duration = time.Duration(now.UnixNano() % int64(s.Interval))
+        return now.Add(s.Interval - timePastTest)
+    }
+    if (now.Before(s.Start)) {
+        return s.Start
+    }
+    passed := now.Sub(s.Start) / s.Interval
+    return s.Start.Add((passed + 1) * s.Interval)
+}
+
+// Done reports whether the campaign ends before the round that attacks at
+// next, after ran rounds.
+func (s Schedule) Done(ran int64, next time.Time) (bool) {
+    if (s.Rounds > 0 && ran >= s.Rounds) {
+        return true
+    }
+    if (s.Duration > 0 && next.After(s.Began.Add(s.Duration))) {
+        return true
+    }
+    return false
+}
+
+// The totals of the campaign, printed when it ends.
+type CampaignSummary struct {
+    Began time.Time `json:"began"`
+    Rounds int64 `json:"rounds"`
+    Precomputed uint64 `json:"precomputed"`
+    Published uint64 `json:"published"`
+    // The raw moved by funding the accounts and by the published sends.
+    Moved *big.Int `json:"moved"`
+    // The outcomes of the campaign, of every round and of every account.
+    Outcomes OutcomeCounts `json:"outcomes"`
+    RoundOutcomes []OutcomeCounts `json:"round_outcomes"`
+    AccountOutcomes []OutcomeCounts `json:"account_outcomes"`
+    Confirmed uint64 `json:"confirmed"`
+    Confirmations []ConfirmReport `json:"confirmations"`
+    // The peer server, when coordinating.
+    Peers *PeerMetrics `json:"peers,omitempty"`
+    // The work shared with every peer.
+    SharedWork map[string]WorkShare `json:"shared_work,omitempty"`
+}
+
+var Summary = CampaignSummary{Moved: big.NewInt(0)}
+
+func (c CampaignSummary) Print() {
+    elapsed := time.Since(c.Began)
+    fmt.Println("---Campaign Summary---")
+    fmt.Println("Duration:", elapsed.Round(time.Second))
+    fmt.Println("Rounds:", c.Rounds)
+    fmt.Println("Blocks Precomputed:", c.Precomputed)
+    fmt.Println("Blocks Published:", c.Published)
+    fmt.Println("Funds Moved:", c.Moved, "raw")
+    if (Confirm) {
+        fmt.Println("Blocks Confirmed:", c.Confirmed)
+    }
+    fmt.Println("Outcomes:", c.Outcomes)
+    if (c.Peers != nil) {
+        c.Peers.Print()
+    }
+    printWorkShares(c.SharedWork)
+    // Only the accounts where something went wrong.
+    for k, o := range c.AccountOutcomes {
+        if (o[Progress] < o.Total()) {
+            fmt.Println("Account:", Accounts[k], "Outcomes:", o)
+        }
+    }
+}
+
+// Write saves the summary as json.
+func (c CampaignSummary) Write(path string) {
+    b, err := json.MarshalIndent(c, "", "    ")
+    if err == nil {
+        err = ioutil.WriteFile(path, b, 0644)
+    }
+    if err != nil {
+        fmt.Println("Error: Unable to write the summary:", err)
+        os.Exit(1)
+    }
+    fmt.Println("Summary written to:", path)
+}
+
+// finishCampaign prints the summary and writes it if there is a path.
+func finishCampaign(path string) {
+    if (Confirm) {
+        fmt.Println("---Waiting for Confirmations---")
+        Trackers.Wait()
+    }
+    if (Serving) {
+        peers := Metrics.Snapshot()
+        Summary.Peers = &peers
+        Summary.SharedWork = workShares()
+    }
+    Summary.Print()
+    if (path != "") {
+        Summary.Write(path)
+    }
+}
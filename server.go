@@ -0,0 +1,257 @@
+/*
+ * Copyright (C) 2018 Keaton Bruce
+ *
+ * This file is part of nano-prepowtx.
+ *
+ * nano-prepowtx is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * nano-prepowtx is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with nano-prepowtx. If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+    "fmt"
+    "io"
+    "net"
+    "sync"
+    "sync/atomic"
+    "time"
+    "errors"
+    "crypto/tls"
+)
+
+/*
+ * The peer server must outlive any peer that misbehaves. Whatever goes wrong
+ * on a connection closes that connection only and is counted in Metrics:
+ *
+ *     - A connection is refused when MaxPeerConns are already open.
+ *     - Every host may open PeerRate connections per second, and every
+ *       identity may send PeerRate messages per second once its handshake
+ *       proved it. A connection that goes over is closed. Hosts on loopback
+ *       are not limited, since every instance of a test cluster on one
+ *       machine comes from there, and they are still limited by identity.
+ *     - A peer has PeerIdleTimeout to send its next message and
+ *       PeerWriteTimeout to take an answer.
+ *     - A message may not be larger than MaxMessageSize.
+ */
+
+const MaxPeerConns = 64
+const MaxMessageSize = 1 << 20
+const PeerRate = 20
+const PeerBurst = 40
+const PeerIdleTimeout = 2 * time.Minute
+const PeerWriteTimeout = 10 * time.Second
+
+// The time a request may take from the side that makes it.
+const PeerCallTimeout = 30 * time.Second
+
+var ErrMessageTooLarge = errors.New("the message is too large")
+var ErrRateLimited = errors.New("the peer sends too fast")
+
+type PeerMetrics struct {
+    Accepted uint64 `json:"accepted"`
+    Refused uint64 `json:"refused"`
+    RateLimited uint64 `json:"rate_limited"`
+    HandshakeErrors uint64 `json:"handshake_errors"`
+    Timeouts uint64 `json:"timeouts"`
+    TooLarge uint64 `json:"too_large"`
+    // Unsigned, untrusted and replayed frames.
+    Rejected uint64 `json:"rejected"`
+    OtherErrors uint64 `json:"other_errors"`
+    Handled uint64 `json:"handled"`
+}
+
+var Metrics PeerMetrics
+
+// Whether this node serves peers, so their metrics are in the summary.
+var Serving bool
+
+// Snapshot returns a copy of the metrics that is safe to read.
+func (m *PeerMetrics) Snapshot() (PeerMetrics) {
+    return PeerMetrics{
+        atomic.LoadUint64(&m.Accepted),
+        atomic.LoadUint64(&m.Refused),
+        atomic.LoadUint64(&m.RateLimited),
+        atomic.LoadUint64(&m.HandshakeErrors),
+        atomic.LoadUint64(&m.Timeouts),
+        atomic.LoadUint64(&m.TooLarge),
+        atomic.LoadUint64(&m.Rejected),
+        atomic.LoadUint64(&m.OtherErrors),
+        atomic.LoadUint64(&m.Handled),
+    }
+}
+
+func (m PeerMetrics) Print() {
+    fmt.Println("Peer Connections Accepted:", m.Accepted, "Refused:", m.Refused, "Messages Handled:", m.Handled)
+    fmt.Println("Peer Errors Rate Limited:", m.RateLimited, "Handshake:", m.HandshakeErrors, "Timeouts:", m.Timeouts,
+        "Too Large:", m.TooLarge, "Rejected:", m.Rejected, "Other:", m.OtherErrors)
+}
+
+// limitReader fails a read once more than its limit was read. The limit is
+// reset for every message.
+type limitReader struct {
+    r io.Reader
+    n int64
+}
+
+func (l *limitReader) Read(p []byte) (int, error) {
+    if (l.n <= 0) {
+        return 0, ErrMessageTooLarge
+    }
+    if (int64(len(p)) > l.n) {
+        p = p[:l.n]
+    }
+    n, err := l.r.Read(p)
+    l.n -= int64(n)
+    return n, err
+}
+
+type addressLimit struct {
+    bucket *TokenBucket
+    last time.Time
+}
+
+// The rate limits of every remote host and of every identity.
+var limits = make(map[string]*addressLimit)
+var lLock sync.Mutex
+
+// allow takes a token from the bucket of a host or an identity.
+func allow(id string) (bool) {
+    lLock.Lock()
+    defer lLock.Unlock()
+    now := time.Now()
+    l, ok := limits[id]
+    if (!ok) {
+        if (len(limits) >= 4 * MaxPeerConns) {
+            for h, old := range limits {
+                if (now.Sub(old.last) > time.Minute) {
+                    delete(limits, h)
+                }
+            }
+        }
+        l = &addressLimit{NewTokenBucket(PeerRate, PeerBurst), now}
+        limits[id] = l
+    }
+    l.last = now
+    return l.bucket.Allow()
+}
+
+// countError counts what went wrong on a connection.
+func countError(err error) {
+    var ne net.Error
+    switch {
+    case errors.As(err, &ne) && ne.Timeout():
+        atomic.AddUint64(&Metrics.Timeouts, 1)
+    case errors.Is(err, ErrMessageTooLarge):
+        atomic.AddUint64(&Metrics.TooLarge, 1)
+    case errors.Is(err, ErrRateLimited):
+        atomic.AddUint64(&Metrics.RateLimited, 1)
+    case errors.Is(err, ErrUnsigned), errors.Is(err, ErrBadSignature), errors.Is(err, ErrNotAllowed), errors.Is(err, ErrReplayed), errors.Is(err, ErrWrongSigner):
+        atomic.AddUint64(&Metrics.Rejected, 1)
+    default:
+        atomic.AddUint64(&Metrics.OtherErrors, 1)
+    }
+}
+
+// serv accepts peers on a listener until it is closed.
+func serv(ln net.Listener) {
+    // The purpose of this function is to listen for new connections concurrently.
+    slots := make(chan struct{}, MaxPeerConns)
+    var backoff time.Duration
+    for {
+        conn, err := ln.Accept()
+        if err != nil {
+            if errors.Is(err, net.ErrClosed) {
+                return
+            }
+            // Out of file descriptors and the like, wait for it to pass.
+            if (backoff == 0) {
+                backoff = 5 * time.Millisecond
+            } else if (backoff < time.Second) {
+                backoff *= 2
+            }
+            fmt.Println("Error: Accepting peers:", err)
+            time.Sleep(backoff)
+            continue
+        }
+        backoff = 0
+        select {
+        case slots <- struct{}{}:
+            atomic.AddUint64(&Metrics.Accepted, 1)
+            go func() {
+                handleConnection(conn)
+                <-slots
+            }()
+        default:
+            atomic.AddUint64(&Metrics.Refused, 1)
+            conn.Close()
+        }
+    }
+}
+
+func handleConnection(conn net.Conn) {
+    // This function handles requests.
+    // Every message is answered until the peer hangs up, hello fails or the
+    // peer misbehaves.
+    defer conn.Close()
+
+    fmt.Printf("...Connection Established to %s...\n", conn.RemoteAddr())
+    host := remoteHost(conn)
+    ip := net.ParseIP(host)
+    if ((ip == nil || !ip.IsLoopback()) && !allow(host)) {
+        countError(ErrRateLimited)
+        return
+    }
+    // The handshake gets as long as an answer.
+    conn.SetDeadline(time.Now().Add(PeerWriteTimeout))
+    c, err := newPeerConn(conn.(*tls.Conn))
+    if err != nil {
+        fmt.Println("Error: Peer", conn.RemoteAddr(), err)
+        atomic.AddUint64(&Metrics.HandshakeErrors, 1)
+        return
+    }
+    for {
+        conn.SetDeadline(time.Now().Add(PeerIdleTimeout))
+        m, err := c.receive()
+        if (err == nil && !allow(c.key)) {
+            err = ErrRateLimited
+        }
+        if err != nil {
+            if (err != io.EOF) {
+                fmt.Println("Error: Peer", conn.RemoteAddr(), err)
+                countError(err)
+            }
+            break
+        }
+        r := c.handle(m)
+        atomic.AddUint64(&Metrics.Handled, 1)
+        r.Header.Version = c.version
+        if (r.Header.Version == 0) {
+            r.Header.Version = ProtocolVersion
+        }
+        r.Header.Reply = m.Header.ID
+        conn.SetDeadline(time.Now().Add(PeerWriteTimeout))
+        err = c.send(r)
+        if err != nil {
+            fmt.Println("Error: Peer", conn.RemoteAddr(), err)
+            countError(err)
+            break
+        }
+        if (c.version == 0) {
+            // Nothing but hello is answered before hello.
+            break
+        }
+    }
+    fmt.Println("...Terminating Connection...")
+}
@@ -0,0 +1,56 @@
+/*
+ * Copyright (C) 2018 Keaton Bruce
+ *
+ * This file is part of nano-prepowtx.
+ *
+ * nano-prepowtx is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * nano-prepowtx is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with nano-prepowtx. If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+    "fmt"
+    "os"
+    "context"
+    "os/signal"
+    "syscall"
+)
+
+/*
+ * The first SIGINT or SIGTERM cancels the Campaign context. Precomputation is
+ * halted, the block that is being published is finished and the campaign ends
+ * with its summary. A second signal exits right away.
+ */
+
+// Campaign is done when the campaign is shutting down.
+var Campaign, stopCampaign = context.WithCancel(context.Background())
+
+func handleSignals() {
+    sig := make(chan os.Signal, 2)
+    signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+    go func() {
+        s := <-sig
+        fmt.Println("\n---Received", s, "Shutting Down---")
+        stopCampaign()
+        <-sig
+        fmt.Println("\n---Exiting Without a Summary---")
+        os.Exit(1)
+    }()
+}
+
+// stopping reports whether the campaign is shutting down.
+func stopping() (bool) {
+    return Campaign.Err() != nil
+}
@@ -0,0 +1,151 @@
+/*
+ * Copyright (C) 2018 Keaton Bruce
+ *
+ * This file is part of nano-prepowtx.
+ *
+ * nano-prepowtx is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * nano-prepowtx is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with nano-prepowtx. If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+    "fmt"
+    "os"
+)
+
+/*
+ * A topology decides who sends to whom. The i-th send block of a round goes
+ * from one account to another, and the receive blocks are later created for
+ * whatever destinations the sends had, so any topology can be used.
+ *
+ * ring     - every account sends to the next one.
+ * star     - the spokes send to the hub and the hub sends back to the spokes.
+ * fan_in   - every spoke sends to the hub.
+ * fan_out  - the hub sends to every spoke.
+ * random   - random pairs of accounts, repeatable with the same seed.
+ * mesh     - every account sends to every other account.
+ */
+
+type Topology interface {
+    // Transfer returns the sending and the receiving account of the i-th send.
+    Transfer(i uint64) (uint64, uint64)
+}
+
+// The topology of the current campaign.
+var Topo Topology
+
+func NewTopology(name string, n uint64, hub uint64, seed uint64) (Topology) {
+    if (n < 2) {
+        fmt.Println("Error: A topology needs at least 2 accounts.")
+        os.Exit(1)
+    }
+    if (hub >= n) {
+        fmt.Println("Error: The hub", hub, "is not one of the", n, "accounts.")
+        os.Exit(1)
+    }
+    switch name {
+    case "ring":
+        return Ring{n}
+    case "star":
+        return Star{n, hub}
+    case "fan_in":
+        return FanIn{n, hub}
+    case "fan_out":
+        return FanOut{n, hub}
+    case "random":
+        return Random{n, seed}
+    case "mesh":
+        return Mesh{n}
+    }
+    fmt.Println("Error: Unknown topology:", name)
+    os.Exit(1)
+    return nil
+}
+
+type Ring struct {
+    N uint64
+}
+
+func (t Ring) Transfer(i uint64) (uint64, uint64) {
+    from := i % t.N
+    return from, (from + 1) % t.N
+}
+
+// spoke returns the s-th account that is not the hub.
+func spoke(s, hub uint64) (uint64) {
+    if (s >= hub) {
+        return s + 1
+    }
+    return s
+}
+
+type Star struct {
+    N uint64
+    Hub uint64
+}
+
+func (t Star) Transfer(i uint64) (uint64, uint64) {
+    p := i % (2 * (t.N - 1))
+    s := spoke(p / 2, t.Hub)
+    if (p % 2 == 0) {
+        return s, t.Hub
+    }
+    return t.Hub, s
+}
+
+type FanIn struct {
+    N uint64
+    Hub uint64
+}
+
+func (t FanIn) Transfer(i uint64) (uint64, uint64) {
+    return spoke(i % (t.N - 1), t.Hub), t.Hub
+}
+
+type FanOut struct {
+    N uint64
+    Hub uint64
+}
+
+func (t FanOut) Transfer(i uint64) (uint64, uint64) {
+    return t.Hub, spoke(i % (t.N - 1), t.Hub)
+}
+
+type Random struct {
+    N uint64
+    Seed uint64
+}
+
+// The pair only depends on the seed and i, so a round can be replayed.
+func (t Random) Transfer(i uint64) (uint64, uint64) {
+    // splitmix64
+    x := t.Seed + (i + 1) * 0x9e3779b97f4a7c15
+    x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+    x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+    x = x ^ (x >> 31)
+
+    from := (x & 0xffffffff) % t.N
+    return from, (from + 1 + (x >> 32) % (t.N - 1)) % t.N
+}
+
+type Mesh struct {
+    N uint64
+}
+
+func (t Mesh) Transfer(i uint64) (uint64, uint64) {
+    p := i % (t.N * (t.N - 1))
+    from := p / (t.N - 1)
+    return from, (from + 1 + p % (t.N - 1)) % t.N
+}
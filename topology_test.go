@@ -0,0 +1,93 @@
+/*
+ * Copyright (C) 2018 Keaton Bruce
+ *
+ * This file is part of nano-prepowtx.
+ *
+ * nano-prepowtx is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * nano-prepowtx is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with nano-prepowtx. If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+    "testing"
+)
+
+func TestTopologies(t *testing.T) {
+    // Four accounts with account 1 as the hub.
+    for _, tc := range []struct {
+        name string
+        transfers [][2]uint64
+        // The sends and receives of every account in one cycle.
+        sends, receives []uint64
+    }{
+        {"ring", [][2]uint64{{0, 1}, {1, 2}, {2, 3}, {3, 0}}, []uint64{1, 1, 1, 1}, []uint64{1, 1, 1, 1}},
+        {"star", [][2]uint64{{0, 1}, {1, 0}, {2, 1}, {1, 2}, {3, 1}, {1, 3}}, []uint64{1, 3, 1, 1}, []uint64{1, 3, 1, 1}},
+        {"fan_in", [][2]uint64{{0, 1}, {2, 1}, {3, 1}}, []uint64{1, 0, 1, 1}, []uint64{0, 3, 0, 0}},
+        {"fan_out", [][2]uint64{{1, 0}, {1, 2}, {1, 3}}, []uint64{0, 3, 0, 0}, []uint64{1, 0, 1, 1}},
+        {"mesh", [][2]uint64{{0, 1}, {0, 2}, {0, 3}, {1, 2}, {1, 3}, {1, 0}, {2, 3}, {2, 0}, {2, 1}, {3, 0}, {3, 1}, {3, 2}}, []uint64{3, 3, 3, 3}, []uint64{3, 3, 3, 3}},
+    } {
+        topo := NewTopology(tc.name, 4, 1, 7)
+        sends := make([]uint64, 4)
+        receives := make([]uint64, 4)
+        // Two cycles, the second one repeats the first.
+        for i := uint64(0); i < uint64(2 * len(tc.transfers)); i++ {
+            from, to := topo.Transfer(i)
+            want := tc.transfers[i % uint64(len(tc.transfers))]
+            if (from != want[0] || to != want[1]) {
+                t.Fatalf("%s: transfer %d is %d -> %d, want %d -> %d", tc.name, i, from, to, want[0], want[1])
+            }
+            sends[from]++
+            receives[to]++
+        }
+        for k := range sends {
+            if (sends[k] != 2 * tc.sends[k] || receives[k] != 2 * tc.receives[k]) {
+                t.Errorf("%s: account %d sent %d and received %d in two cycles, want %d and %d", tc.name, k, sends[k], receives[k], 2 * tc.sends[k], 2 * tc.receives[k])
+            }
+        }
+    }
+}
+
+// The random pairs are never an account with itself, are the same for the
+// same seed and are spread over every account.
+func TestRandomTopology(t *testing.T) {
+    const n, draws = 4, 4000
+    topo := NewTopology("random", n, 0, 7)
+    other := NewTopology("random", n, 0, 8)
+    sends := make([]uint64, n)
+    receives := make([]uint64, n)
+    same := 0
+    for i := uint64(0); i < draws; i++ {
+        from, to := topo.Transfer(i)
+        if (from >= n || to >= n || from == to) {
+            t.Fatalf("transfer %d is %d -> %d", i, from, to)
+        }
+        if f, r := topo.Transfer(i); (f != from || r != to) {
+            t.Fatalf("transfer %d is not repeatable", i)
+        }
+        if f, r := other.Transfer(i); (f == from && r == to) {
+            same++
+        }
+        sends[from]++
+        receives[to]++
+    }
+    if (same == draws) {
+        t.Fatalf("the seed does not change the transfers")
+    }
+    for k := range sends {
+        if (sends[k] < draws / n / 2 || receives[k] < draws / n / 2) {
+            t.Errorf("account %d sent %d and received %d of %d transfers", k, sends[k], receives[k], draws)
+        }
+    }
+}
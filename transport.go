@@ -0,0 +1,128 @@
+/*
+ * Copyright (C) 2018 Keaton Bruce
+ *
+ * This file is part of nano-prepowtx.
+ *
+ * nano-prepowtx is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * nano-prepowtx is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with nano-prepowtx. If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+    "fmt"
+    "os"
+    "net"
+    "time"
+    "errors"
+    "math/big"
+    "crypto/ed25519"
+    "crypto/rand"
+    "crypto/tls"
+    "crypto/x509"
+    "crypto/x509/pkix"
+    "encoding/hex"
+)
+
+/*
+ * Peers talk TLS 1.3 with each other. The certificate of every instance is
+ * self-signed with its ed25519 identity, so there is no certificate authority
+ * to trust: instead the key of the certificate is pinned. With an allowlist
+ * only its keys get through the handshake. With a cluster secret the
+ * handshake accepts any identity and the frames are left to prove that the
+ * peer knows the secret. Without either no peer gets through.
+ *
+ * The frames on a connection must be signed by the same identity as the
+ * certificate, so a frame cannot be moved to the connection of another peer.
+ */
+
+var ErrNoIdentity = errors.New("the peer did not present an ed25519 certificate")
+
+var tlsConfig *tls.Config
+
+// setupTransport creates the certificate of this node. It needs the identity.
+func setupTransport() {
+    template := x509.Certificate{
+        SerialNumber: big.NewInt(1),
+        Subject: pkix.Name{CommonName: NodeKey()},
+        NotBefore: time.Now().Add(-time.Hour),
+        NotAfter: time.Now().Add(10 * 365 * 24 * time.Hour),
+        KeyUsage: x509.KeyUsageDigitalSignature,
+        ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+    }
+    der, err := x509.CreateCertificate(rand.Reader, &template, &template, Identity.Public(), Identity)
+    if err != nil {
+        fmt.Println("Error: Unable to create the certificate:", err)
+        os.Exit(1)
+    }
+    tlsConfig = &tls.Config{
+        Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: Identity}},
+        MinVersion: tls.VersionTLS13,
+        ClientAuth: tls.RequireAnyClientCert,
+        // The certificates are self-signed, verifyPeer pins their keys instead.
+        InsecureSkipVerify: true,
+        VerifyPeerCertificate: verifyPeer,
+    }
+}
+
+// verifyPeer accepts a self-signed ed25519 certificate of a trusted identity.
+func verifyPeer(raw [][]byte, _ [][]*x509.Certificate) (error) {
+    if (len(raw) == 0) {
+        return ErrNoIdentity
+    }
+    cert, err := x509.ParseCertificate(raw[0])
+    if err != nil {
+        return err
+    }
+    key, ok := cert.PublicKey.(ed25519.PublicKey)
+    if (!ok) {
+        return ErrNoIdentity
+    }
+    err = cert.CheckSignature(cert.SignatureAlgorithm, cert.RawTBSCertificate, cert.Signature)
+    if err != nil {
+        return err
+    }
+    if (ClusterSecret == nil && !Allowed[hex.EncodeToString(key)]) {
+        return ErrNotAllowed
+    }
+    return nil
+}
+
+// peerKey returns the identity of the peer of a connection after the
+// handshake, in hex.
+func peerKey(conn *tls.Conn) (string, error) {
+    err := conn.Handshake()
+    if err != nil {
+        return "", err
+    }
+    certs := conn.ConnectionState().PeerCertificates
+    if (len(certs) == 0) {
+        return "", ErrNoIdentity
+    }
+    key, ok := certs[0].PublicKey.(ed25519.PublicKey)
+    if (!ok) {
+        return "", ErrNoIdentity
+    }
+    return hex.EncodeToString(key), nil
+}
+
+// listenPeers listens for TLS connections of peers.
+func listenPeers(address string) (net.Listener, error) {
+    return tls.Listen("tcp", address, tlsConfig)
+}
+
+// dialTLS connects to a peer over TLS.
+func dialTLS(address string) (*tls.Conn, error) {
+    return tls.DialWithDialer(&net.Dialer{Timeout: PeerDialTimeout}, "tcp", address, tlsConfig)
+}
@@ -0,0 +1,98 @@
+/*
+ * Copyright (C) 2018 Keaton Bruce
+ *
+ * This file is part of nano-prepowtx.
+ *
+ * nano-prepowtx is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * nano-prepowtx is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with nano-prepowtx. If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+    "net"
+    "testing"
+    "crypto/tls"
+    "crypto/ed25519"
+)
+
+// configFor returns the TLS configuration of an identity.
+func configFor(identity ed25519.PrivateKey) (*tls.Config) {
+    Identity = identity
+    setupTransport()
+    return tlsConfig
+}
+
+// handshake connects a client to a server over loopback and returns both
+// ends with the errors of their handshakes. A pipe would block on the writes
+// that TLS 1.3 makes after the handshake.
+func handshake(t *testing.T, server, client *tls.Config) (*tls.Conn, *tls.Conn, error, error) {
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer ln.Close()
+    done := make(chan error, 1)
+    var cc *tls.Conn
+    go func() {
+        conn, err := net.Dial("tcp", ln.Addr().String())
+        if err != nil {
+            done <- err
+            return
+        }
+        cc = tls.Client(conn, client)
+        done <- cc.Handshake()
+    }()
+    conn, err := ln.Accept()
+    if err != nil {
+        t.Fatal(err)
+    }
+    sc := tls.Server(conn, server)
+    serr := sc.Handshake()
+    cerr := <-done
+    return sc, cc, serr, cerr
+}
+
+func TestVerifyPeer(t *testing.T) {
+    serverIdentity, serverKey := newIdentity(t)
+    clientIdentity, clientKey := newIdentity(t)
+    server := configFor(serverIdentity)
+    client := configFor(clientIdentity)
+
+    trust(clientIdentity, "", serverKey, clientKey)
+    sc, cc, serr, cerr := handshake(t, server, client)
+    if (serr != nil || cerr != nil) {
+        t.Fatalf("handshake of allowed identities: server %v, client %v", serr, cerr)
+    }
+    if key, err := peerKey(sc); (err != nil || key != clientKey) {
+        t.Fatalf("the server sees %s, %v, want %s", key, err, clientKey)
+    }
+    if key, err := peerKey(cc); (err != nil || key != serverKey) {
+        t.Fatalf("the client sees %s, %v, want %s", key, err, serverKey)
+    }
+    sc.Close()
+    cc.Close()
+
+    // The client is not on the allowlist of the server.
+    trust(clientIdentity, "", serverKey)
+    sc, cc, serr, _ = handshake(t, server, client)
+    if (serr == nil) {
+        t.Fatalf("the server accepted an identity that is not allowed")
+    }
+    if _, err := peerKey(sc); err == nil {
+        t.Fatalf("an identity that is not allowed has a key")
+    }
+    sc.Close()
+    cc.Close()
+}
@@ -0,0 +1,488 @@
+/*
+ * Copyright (C) 2018 Keaton Bruce
+ *
+ * This file is part of nano-prepowtx.
+ *
+ * nano-prepowtx is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * nano-prepowtx is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with nano-prepowtx. If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+    "fmt"
+    "sort"
+    "sync"
+    "time"
+    "hash/fnv"
+    "encoding/hex"
+)
+
+/*
+ * Peers with spare PoW capacity compute work for the blocks of others. The
+ * root of the work of the next block of an account is its frontier, so it is
+ * known as soon as the block before it was created. A coordinating node asks
+ * for the work of every new frontier with request_pow, and every frontier is
+ * asked of a single helper, chosen by its hash among the live peers that
+ * handle request_pow. Nodes only handle it when they run with -share_pow.
+ *
+ * A helper queues the frontiers it was asked for, computes their work with
+ * its own node and relays it back with relay_pow about every RelayInterval.
+ * A frontier that is already queued is not queued again. It refuses work
+ * above the highest threshold of its own node and policy, refreshed every
+ * ShareRefresh, so a peer cannot keep it busy forever. Work that its node
+ * fails to compute is dropped and left to the peer.
+ *
+ * Relayed work is only taken for frontiers that were asked for and do not have
+ * work yet. It is validated by our node when it arrives and must meet the
+ * difficulty that was asked for. When the next block of the account is
+ * created the work is used if it meets the threshold of the block, otherwise
+ * the node computes it as before. What every peer relayed, what was accepted,
+ * used or rejected and what we computed for it is counted in WorkShares.
+ */
+
+const ActionRequestPoW = "request_pow"
+
+// The most work in one request_pow or relay_pow.
+const MaxRelayedWork = 256
+// The most frontiers that a helper queues.
+const ShareQueue = 4 * MaxRelayedWork
+// The time between relays of computed work, and between requests for it.
+const RelayInterval = time.Second
+// The time between updates of the highest difficulty a helper computes.
+const ShareRefresh = time.Minute
+
+// The work shared with a peer, by address, or by identity for a peer that
+// does not listen.
+type WorkShare struct {
+    // The work the peer relayed to us.
+    Received uint64 `json:"received"`
+    Accepted uint64 `json:"accepted"`
+    Used uint64 `json:"used"`
+    // Work for a frontier that already had work.
+    Duplicate uint64 `json:"duplicate"`
+    // Work that failed validation.
+    Invalid uint64 `json:"invalid"`
+    // Work that was not asked for, or came after its block was created.
+    Unsolicited uint64 `json:"unsolicited"`
+    // Accepted work that was below the threshold of its block when it was used.
+    Stale uint64 `json:"stale"`
+    // The work we computed for the peer.
+    Computed uint64 `json:"computed"`
+}
+
+type SharedWork struct {
+    Work string
+    Difficulty uint64
+    From string
+}
+
+var WorkShares = make(map[string]*WorkShare)
+
+// Whether the work of new frontiers is asked of the peers.
+var requesting bool
+// The frontiers that work was asked for, with the difficulty asked for.
+var wanted = make(map[string]uint64)
+// Validated work that was not used yet, by frontier.
+var shared = make(map[string]SharedWork)
+// The frontiers to ask for with the next request.
+var asking []string
+// The thresholds of sends and receives this round.
+var sendThreshold, receiveThreshold uint64
+var wLock sync.Mutex
+
+type workJob struct {
+    Root string
+    Difficulty string
+    Address string
+}
+
+// The frontiers that a helper computes, and the work it computed for every
+// peer that was not relayed yet.
+var jobs = make(chan workJob, ShareQueue)
+var queued = make(map[string]bool)
+var outbox = make(map[string][]RelayedWork)
+// The highest difficulty a helper computes, zero while it is not known.
+var shareLimit uint64
+
+// share returns the accounting of a peer. Hold wLock.
+func share(address string) (*WorkShare) {
+    s, ok := WorkShares[address]
+    if (!ok) {
+        s = &WorkShare{}
+        WorkShares[address] = s
+    }
+    return s
+}
+
+// isHex reports whether s is n bytes in hex.
+func isHex(s string, n int) (bool) {
+    b, err := hex.DecodeString(s)
+    return err == nil && len(b) == n
+}
+
+// shareWork makes this node a helper that computes work for its peers with
+// workers requests to its node at once.
+func shareWork(workers int) {
+    refreshShareLimit()
+    Handlers[ActionRequestPoW] = handleRequestPoW
+    for i := 0; i < workers; i++ {
+        go computeWork()
+    }
+    go relayWork()
+}
+
+// requestWork asks the peers for the work of the frontiers of every round.
+func requestWork() {
+    wLock.Lock()
+    requesting = true
+    wLock.Unlock()
+    go func() {
+        ticker := time.NewTicker(RelayInterval)
+        defer ticker.Stop()
+        for {
+            select {
+            case <-ticker.C:
+            case <-Campaign.Done():
+                return
+            }
+            flushRequests()
+        }
+    }()
+}
+
+// thresholds returns the thresholds of sends and receives of the policy and
+// the network. Without the network only those of the policy are known.
+func thresholds() (uint64, uint64, error) {
+    networkMinimum, networkCurrent, err := ActiveDifficulty()
+    var minimum, current uint64
+    if err == nil {
+        minimum = ParseDifficulty(networkMinimum)
+        current = ParseDifficulty(networkCurrent)
+    }
+    return Policy.Threshold("send", minimum, current), Policy.Threshold("receive", minimum, current), err
+}
+
+// refreshShareLimit sets the highest difficulty a helper computes to the
+// highest threshold of its node.
+func refreshShareLimit() {
+    send, receive, err := thresholds()
+    if err != nil {
+        fmt.Println("Error: Unable to get the active difficulty:", err)
+    }
+    if (receive > send) {
+        send = receive
+    }
+    wLock.Lock()
+    shareLimit = send
+    wLock.Unlock()
+}
+
+// requestFrontiers updates the thresholds and asks again for every frontier
+// that has no work yet, as a helper may have dropped it.
+func requestFrontiers() {
+    send, receive, err := thresholds()
+    if err != nil {
+        fmt.Println("Error: Unable to get the active difficulty:", err)
+    }
+    wLock.Lock()
+    sendThreshold = send
+    receiveThreshold = receive
+    wLock.Unlock()
+    for _, root := range Frontiers {
+        wantWork(root)
+    }
+}
+
+// wantWork asks the peers for the work of a new frontier.
+func wantWork(root string) {
+    wLock.Lock()
+    defer wLock.Unlock()
+    if (!requesting) {
+        return
+    }
+    if _, ok := shared[root]; ok {
+        return
+    }
+    // Work that is good for either subtype.
+    difficulty := sendThreshold
+    if (receiveThreshold > difficulty) {
+        difficulty = receiveThreshold
+    }
+    wanted[root] = difficulty
+    asking = append(asking, root)
+}
+
+// takeWork returns relayed work for the next block on a frontier, or nothing
+// to have the node compute it. The frontier is not asked for any longer.
+func takeWork(root, subtype string) (string) {
+    wLock.Lock()
+    defer wLock.Unlock()
+    delete(wanted, root)
+    w, ok := shared[root]
+    if (!ok) {
+        return ""
+    }
+    delete(shared, root)
+    threshold := receiveThreshold
+    if (subtype == "send") {
+        threshold = sendThreshold
+    }
+    if (w.Difficulty < threshold) {
+        share(w.From).Stale++
+        return ""
+    }
+    share(w.From).Used++
+    return w.Work
+}
+
+// helpers returns the live peers that compute work.
+func helpers() ([]string) {
+    self := advertised()
+    pLock.Lock()
+    defer pLock.Unlock()
+    var addresses []string
+    for address, p := range peers {
+        if (address == self || !p.live()) {
+            continue
+        }
+        for _, a := range p.Capabilities {
+            if (a == ActionRequestPoW) {
+                addresses = append(addresses, address)
+                break
+            }
+        }
+    }
+    sort.Strings(addresses)
+    return addresses
+}
+
+// flushRequests asks the helpers for the frontiers that were added since the
+// last request.
+func flushRequests() {
+    addresses := helpers()
+    wLock.Lock()
+    roots := asking
+    asking = nil
+    if (len(addresses) == 0) {
+        // They are asked for again next round.
+        wLock.Unlock()
+        return
+    }
+    batches := make(map[string][]RelayedWork)
+    for _, root := range roots {
+        difficulty, ok := wanted[root]
+        if (!ok) {
+            // Its block was created in the meantime.
+            continue
+        }
+        h := fnv.New32a()
+        h.Write([]byte(root))
+        address := addresses[h.Sum32() % uint32(len(addresses))]
+        batches[address] = append(batches[address], RelayedWork{Hash: root, Difficulty: FormatDifficulty(difficulty)})
+    }
+    wLock.Unlock()
+    for address, batch := range batches {
+        go func(address string, batch []RelayedWork) {
+            for len(batch) > 0 {
+                n := len(batch)
+                if (n > MaxRelayedWork) {
+                    n = MaxRelayedWork
+                }
+                _, err := request(address, ActionRequestPoW, Message{Work: batch[:n]})
+                if err != nil {
+                    fmt.Println("Error: Peer", address, ActionRequestPoW, err)
+                    return
+                }
+                batch = batch[n:]
+            }
+        }(address, batch)
+    }
+}
+
+func handleRequestPoW(c *PeerConn, m Message) (Message) {
+    if (len(m.Work) == 0 || len(m.Work) > MaxRelayedWork) {
+        return protocolError(ErrCodeBadRequest, "request_pow with ", len(m.Work), " frontiers")
+    }
+    if (c.address == "") {
+        return protocolError(ErrCodeUnavailable, "advertise an address to receive work")
+    }
+    for _, w := range m.Work {
+        if (!isHex(w.Hash, 32) || !isHex(w.Difficulty, 8)) {
+            return protocolError(ErrCodeBadRequest, "request_pow with an invalid frontier or difficulty")
+        }
+    }
+    wLock.Lock()
+    defer wLock.Unlock()
+    if (shareLimit == 0) {
+        return protocolError(ErrCodeUnavailable, "the work thresholds of the node are not known")
+    }
+    for _, w := range m.Work {
+        if (ParseDifficulty(w.Difficulty) > shareLimit) {
+            return protocolError(ErrCodeBadRequest, "request_pow above the difficulty ", FormatDifficulty(shareLimit))
+        }
+    }
+    for _, w := range m.Work {
+        if (queued[w.Hash]) {
+            continue
+        }
+        select {
+        case jobs <- workJob{w.Hash, w.Difficulty, c.address}:
+            queued[w.Hash] = true
+        default:
+            return protocolError(ErrCodeUnavailable, "the work queue is full")
+        }
+    }
+    return ack()
+}
+
+// computeWork computes the queued frontiers until the campaign stops.
+func computeWork() {
+    for {
+        var job workJob
+        select {
+        case job = <-jobs:
+        case <-Campaign.Done():
+            return
+        }
+        work, _, err := GenerateWork(job.Root, job.Difficulty)
+        wLock.Lock()
+        if err != nil {
+            // The peer computes it itself.
+            delete(queued, job.Root)
+        } else {
+            outbox[job.Address] = append(outbox[job.Address], RelayedWork{Hash: job.Root, Work: work})
+            share(job.Address).Computed++
+        }
+        wLock.Unlock()
+        if err != nil {
+            fmt.Println("Error: Unable to compute work for peer", job.Address, err)
+        }
+    }
+}
+
+// relayWork relays the computed work to the peers that asked for it.
+func relayWork() {
+    ticker := time.NewTicker(RelayInterval)
+    defer ticker.Stop()
+    refreshed := time.Now()
+    for {
+        select {
+        case <-ticker.C:
+        case <-Campaign.Done():
+            return
+        }
+        if (time.Since(refreshed) > ShareRefresh) {
+            refreshShareLimit()
+            refreshed = time.Now()
+        }
+        wLock.Lock()
+        relaying := outbox
+        outbox = make(map[string][]RelayedWork)
+        wLock.Unlock()
+        for address, work := range relaying {
+            go func(address string, work []RelayedWork) {
+                for len(work) > 0 {
+                    n := len(work)
+                    if (n > MaxRelayedWork) {
+                        n = MaxRelayedWork
+                    }
+                    _, err := request(address, ActionRelayPoW, Message{Work: work[:n]})
+                    if err != nil {
+                        fmt.Println("Error: Peer", address, ActionRelayPoW, err)
+                    }
+                    wLock.Lock()
+                    for _, w := range work[:n] {
+                        delete(queued, w.Hash)
+                    }
+                    wLock.Unlock()
+                    work = work[n:]
+                }
+            }(address, work)
+        }
+    }
+}
+
+func handleRelayPoW(c *PeerConn, m Message) (Message) {
+    if (len(m.Work) > MaxRelayedWork) {
+        return protocolError(ErrCodeBadRequest, "relay_pow with ", len(m.Work), " works")
+    }
+    for _, w := range m.Work {
+        wLock.Lock()
+        s := share(c.name())
+        s.Received++
+        difficulty, ok := wanted[w.Hash]
+        _, done := shared[w.Hash]
+        if (!ok) {
+            s.Unsolicited++
+        } else if (done) {
+            s.Duplicate++
+        }
+        wLock.Unlock()
+        if (!ok || done) {
+            continue
+        }
+
+        // Validate it with our node before it is taken.
+        var d uint64
+        if (isHex(w.Work, 8)) {
+            validated, err := ValidateWork(w.Work, w.Hash)
+            if err != nil {
+                // Not the fault of the peer, it may relay it again.
+                fmt.Println("Error: Unable to validate work from peer", c.name(), err)
+                continue
+            }
+            d = ParseDifficulty(validated)
+        }
+
+        wLock.Lock()
+        if _, done := shared[w.Hash]; done {
+            s.Duplicate++
+        } else if (d == 0 || d < difficulty) {
+            s.Invalid++
+        } else if _, ok := wanted[w.Hash]; ok {
+            shared[w.Hash] = SharedWork{w.Work, d, c.name()}
+            s.Accepted++
+        }
+        wLock.Unlock()
+    }
+    return ack()
+}
+
+// workShares returns a copy of the accounting of every peer.
+func workShares() (map[string]WorkShare) {
+    wLock.Lock()
+    defer wLock.Unlock()
+    if (len(WorkShares) == 0) {
+        return nil
+    }
+    shares := make(map[string]WorkShare, len(WorkShares))
+    for address, s := range WorkShares {
+        shares[address] = *s
+    }
+    return shares
+}
+
+func printWorkShares(shares map[string]WorkShare) {
+    addresses := make([]string, 0, len(shares))
+    for address := range shares {
+        addresses = append(addresses, address)
+    }
+    sort.Strings(addresses)
+    for _, address := range addresses {
+        s := shares[address]
+        fmt.Println("Shared Work Peer:", address, "Received:", s.Received, "Accepted:", s.Accepted, "Used:", s.Used,
+            "Duplicate:", s.Duplicate, "Invalid:", s.Invalid, "Unsolicited:", s.Unsolicited, "Stale:", s.Stale, "Computed:", s.Computed)
+    }
+}
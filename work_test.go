@@ -0,0 +1,99 @@
+/*
+ * Copyright (C) 2018 Keaton Bruce
+ *
+ * This file is part of nano-prepowtx.
+ *
+ * nano-prepowtx is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * nano-prepowtx is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with nano-prepowtx. If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+    "strings"
+    "testing"
+)
+
+// A helper only queues work up to the threshold of its own node, a peer
+// could otherwise keep it busy forever.
+func TestRequestPoWDifficulty(t *testing.T) {
+    c := &PeerConn{address: "peer"}
+    hash := strings.Repeat("A1", 32)
+    request := func(difficulty string) (Message) {
+        return handleRequestPoW(c, Message{Work: []RelayedWork{{Hash: hash, Difficulty: difficulty}}})
+    }
+
+    shareLimit = 0
+    if r := request("ffffffc000000000"); (r.Error == nil || r.Error.Code != ErrCodeUnavailable) {
+        t.Fatalf("queued work without a threshold: %+v", r)
+    }
+    shareLimit = ParseDifficulty("ffffffc000000000")
+    for _, d := range []string{"ffffffffffffffff", "ffffffc000000001"} {
+        if r := request(d); (r.Error == nil || r.Error.Code != ErrCodeBadRequest) {
+            t.Fatalf("difficulty %s was answered with %+v", d, r)
+        }
+    }
+    if (len(jobs) != 0 || queued[hash]) {
+        t.Fatalf("work above the threshold was queued")
+    }
+    if r := request("ffffffc000000000"); (r.Error != nil || !queued[hash] || len(jobs) != 1) {
+        t.Fatalf("work at the threshold was answered with %+v", r)
+    }
+    <-jobs
+    delete(queued, hash)
+}
+
+// Work is relayed to the address a peer advertised, a peer that advertised
+// none would never get it.
+func TestRequestPoWAdvertised(t *testing.T) {
+    serverIdentity, serverKey := newIdentity(t)
+    clientIdentity, clientKey := newIdentity(t)
+    server := configFor(serverIdentity)
+    client := configFor(clientIdentity)
+    trust(serverIdentity, "", serverKey, clientKey)
+    shareLimit = ParseDifficulty("ffffffc000000000")
+    hash := strings.Repeat("B2", 32)
+    work := Message{Work: []RelayedWork{{Hash: hash, Difficulty: "ffffffc000000000"}}}
+
+    for _, advertised := range []string{"", ":7090"} {
+        sc, cc, serr, cerr := handshake(t, server, client)
+        if (serr != nil || cerr != nil) {
+            t.Fatalf("handshake: server %v, client %v", serr, cerr)
+        }
+        defer sc.Close()
+        defer cc.Close()
+        c, err := newPeerConn(sc)
+        if err != nil {
+            t.Fatal(err)
+        }
+        hello := Message{Header: Header{Action: ActionHello}, Hello: &Hello{MinVersion: MinProtocolVersion, MaxVersion: ProtocolVersion, Address: advertised}}
+        if r := c.handle(hello); (r.Error != nil) {
+            t.Fatalf("hello with address %q was answered with %+v", advertised, r.Error)
+        }
+        r := handleRequestPoW(c, work)
+        if (advertised == "") {
+            if (c.address != "" || r.Error == nil || r.Error.Code != ErrCodeUnavailable || queued[hash]) {
+                t.Fatalf("a peer without an address at %q was answered with %+v", c.address, r)
+            }
+            continue
+        }
+        if (c.address != "127.0.0.1:7090" || r.Error != nil || !queued[hash]) {
+            t.Fatalf("a peer at %q was answered with %+v", c.address, r)
+        }
+        if job := <-jobs; (job.Address != "127.0.0.1:7090") {
+            t.Fatalf("the work is relayed to %q", job.Address)
+        }
+        delete(queued, hash)
+    }
+}